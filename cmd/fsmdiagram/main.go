@@ -0,0 +1,63 @@
+package main
+
+// fsmdiagram prints the diagram of a state machine definition, for example
+//
+//	go run ./cmd/fsmdiagram -format mermaid marty
+//	go run ./cmd/fsmdiagram -format dot -current Arriving marty | dot -Tpng > marty.png
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+	"github.com/tonygilkerson/marty/pkg/marty"
+)
+
+// diagrams holds the machines that can be printed, by name.
+var diagrams = map[string]func(format string, current fsm.StateID) string{
+	"marty": func(format string, current fsm.StateID) string {
+		return diagram(marty.States(), format, current)
+	},
+}
+
+func diagram[C any](states fsm.States[C], format string, current fsm.StateID) string {
+	if format == "dot" {
+		return states.DOT(current)
+	}
+	return states.Mermaid(current)
+}
+
+func main() {
+	format := flag.String("format", "mermaid", "diagram format, mermaid or dot")
+	current := flag.String("current", "", "state to highlight")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: fsmdiagram [flags] machine\n\nmachines: %v\n\nflags:\n", names())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || (*format != "mermaid" && *format != "dot") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	render, ok := diagrams[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "fsmdiagram: unknown machine %q, expected one of %v\n", flag.Arg(0), names())
+		os.Exit(2)
+	}
+
+	fmt.Print(render(*format, fsm.StateID(*current)))
+}
+
+// names returns the names of the machines that can be printed.
+func names() []string {
+	var names []string
+	for name := range diagrams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
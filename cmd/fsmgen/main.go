@@ -0,0 +1,613 @@
+package main
+
+// fsmgen generates the Go code of a state machine spec, see package spec. It is
+// meant for go:generate, next to the spec:
+//
+//	//go:generate go run ../../cmd/fsmgen -context Context marty.yaml
+//
+// writes, for a marty.yaml spec
+//
+//	marty_fsm.go       the state, event and timeout constants, States, Bindings and NewStateMachine
+//	marty_fsm_test.go  a test of the transition table
+//	marty_actions.go   a stub for each action and guard the package doesn't define yet
+//
+// The first two are written over every time. Stubs are only ever added to the
+// last one, the actions and guards written by hand are left alone wherever they
+// are in the package.
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+	"github.com/tonygilkerson/marty/pkg/fsm/spec"
+)
+
+// fsmPackage is the import path of package fsm in the generated code.
+const fsmPackage = "github.com/tonygilkerson/marty/pkg/fsm"
+
+func main() {
+	contextType := flag.String("context", "", "context type of the machine, its actions are given a pointer to it")
+	packageName := flag.String("package", os.Getenv("GOPACKAGE"), "package of the generated code, $GOPACKAGE by default")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: fsmgen -context type [flags] spec\n\nflags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *contextType == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := generate(flag.Arg(0), *packageName, *contextType); err != nil {
+		fail(err)
+	}
+}
+
+// generate writes the code of the spec at specPath next to it, for package pkg
+// or the package named after its directory.
+func generate(specPath string, pkg string, contextType string) error {
+	dir := filepath.Dir(specPath)
+	base := strings.TrimSuffix(filepath.Base(specPath), filepath.Ext(specPath))
+	if pkg == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		pkg = filepath.Base(abs)
+	}
+
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		return err
+	}
+	m, err := spec.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%v: %w", specPath, err)
+	}
+
+	g, err := newGenerator(m, pkg, contextType, filepath.Base(specPath))
+	if err != nil {
+		return fmt.Errorf("%v: %w", specPath, err)
+	}
+
+	generated := filepath.Join(dir, base+"_fsm.go")
+	if err := write(generated, g.definition()); err != nil {
+		return err
+	}
+	if err := write(filepath.Join(dir, base+"_fsm_test.go"), g.test()); err != nil {
+		return err
+	}
+
+	declared, err := declarations(dir, generated)
+	if err != nil {
+		return err
+	}
+	return g.addStubs(filepath.Join(dir, base+"_actions.go"), declared)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "fsmgen: %v\n", err)
+	os.Exit(1)
+}
+
+// write formats Go source and writes it to path.
+func write(path string, src []byte) error {
+	formatted, err := format.Source(src)
+	if err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	return os.WriteFile(path, formatted, 0644)
+}
+
+// declarations returns the names declared at the top level of the package in
+// dir, leaving out tests and the generated file.
+func declarations(dir string, generated string) (map[string]bool, error) {
+	fset := token.NewFileSet()
+	packages, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go") && info.Name() != filepath.Base(generated)
+	}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	declared := make(map[string]bool)
+	for _, pkg := range packages {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				switch decl := decl.(type) {
+				case *ast.FuncDecl:
+					if decl.Recv == nil {
+						declared[decl.Name.Name] = true
+					}
+				case *ast.GenDecl:
+					for _, s := range decl.Specs {
+						switch s := s.(type) {
+						case *ast.TypeSpec:
+							declared[s.Name.Name] = true
+						case *ast.ValueSpec:
+							for _, name := range s.Names {
+								declared[name.Name] = true
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return declared, nil
+}
+
+// generator writes the code of a spec.
+type generator struct {
+	machine  *spec.Machine
+	pkg      string
+	context  string
+	specFile string
+
+	// states and events are the names of the constants, in the order they
+	// first come up in the spec. actions and guards are the names they bind.
+	states  []string
+	events  []string
+	actions []string
+	guards  []string
+
+	// timeouts are the names of the timeout constants, by state.
+	timeouts map[string]string
+
+	// emits holds the event the action of a state returns, when there is just
+	// one, for the stubs.
+	emits map[string]string
+}
+
+// newGenerator checks that the spec is a valid definition whose names can be
+// Go identifiers, and collects them.
+func newGenerator(m *spec.Machine, pkg string, context string, specFile string) (*generator, error) {
+	g := &generator{
+		machine:  m,
+		pkg:      pkg,
+		context:  context,
+		specFile: specFile,
+		timeouts: make(map[string]string),
+		emits:    make(map[string]string),
+	}
+
+	// Validate the definition with placeholders for the actions and guards.
+	bindings := fsm.Bindings[struct{}]{
+		Actions: make(map[string]fsm.Action[struct{}]),
+		Guards:  make(map[string]fsm.Guard[struct{}]),
+	}
+	// kinds holds what each name stands for, the generated code declares them
+	// all in the same package. Names that aren't listed have a nil list.
+	kinds := make(map[string]string)
+	var conflicts []string
+	add := func(list *[]string, kind string, name string) {
+		if name == "" {
+			return
+		}
+		if k, ok := kinds[name]; ok {
+			if k != kind {
+				conflicts = append(conflicts, fmt.Sprintf("%q is both a %v and a %v", name, k, kind))
+			}
+			return
+		}
+		kinds[name] = kind
+		if list != nil {
+			*list = append(*list, name)
+		}
+	}
+	addAction := func(name spec.Name) {
+		add(&g.actions, "action", name.Value)
+		bindings.Actions[name.Value] = fsm.ActionFunc[struct{}](func(struct{}) fsm.EventID { return fsm.NoOp })
+	}
+
+	for _, state := range m.States {
+		if state.ID.Value != string(fsm.Default) && state.ID.Value != string(fsm.Any) {
+			add(&g.states, "state", state.ID.Value)
+		}
+	}
+	for _, state := range m.States {
+		for _, edge := range state.Events {
+			add(&g.events, "event", edge.Event.Value)
+		}
+		for _, guarded := range state.Transitions {
+			add(&g.events, "event", guarded.Event.Value)
+		}
+		add(&g.events, "event", state.TimeoutEvent.Value)
+		if state.Timeout.Value != "" {
+			g.timeouts[state.ID.Value] = timeout(state.ID.Value)
+			add(nil, "timeout", g.timeouts[state.ID.Value])
+		}
+		for _, event := range state.Emits {
+			add(&g.events, "event", event.Value)
+		}
+		for _, event := range state.Defer {
+			add(&g.events, "event", event.Value)
+		}
+		if len(state.Emits) == 1 && state.Action.Value != "" {
+			g.emits[state.Action.Value] = state.Emits[0].Value
+		}
+
+		addAction(state.Action)
+		addAction(state.OnEnter)
+		addAction(state.OnExit)
+		for _, guarded := range state.Transitions {
+			for _, t := range guarded.Transitions {
+				addAction(t.Action)
+				add(&g.guards, "guard", t.Guard.Value)
+				bindings.Guards[t.Guard.Value] = func(struct{}, fsm.Event) bool { return true }
+			}
+		}
+	}
+	delete(bindings.Actions, "")
+	delete(bindings.Guards, "")
+
+	states, err := spec.Build(m, bindings)
+	if err != nil {
+		return nil, err
+	}
+	if err := states.Validate(); err != nil {
+		return nil, spec.Locate(m, err)
+	}
+
+	if len(conflicts) > 0 {
+		return nil, errors.New(strings.Join(conflicts, ", "))
+	}
+	for _, names := range [][]string{g.states, g.events, g.actions, g.guards} {
+		for _, name := range names {
+			if !token.IsIdentifier(name) {
+				return nil, fmt.Errorf("%q is not a Go identifier", name)
+			}
+		}
+	}
+	return g, nil
+}
+
+// timeout returns the name of the constant holding the timeout of a state.
+func timeout(name string) string {
+	if fsm.StateID(name) == fsm.Default {
+		name = "Default"
+	}
+	return name + "Timeout"
+}
+
+// state returns the Go expression of a state.
+func state(name string) string {
+	switch fsm.StateID(name) {
+	case fsm.Default:
+		return "fsm.Default"
+	case fsm.Any:
+		return "fsm.Any"
+	}
+	return name
+}
+
+// duration returns the Go expression of a duration.
+func duration(d time.Duration) string {
+	for _, unit := range []struct {
+		d    time.Duration
+		name string
+	}{
+		{time.Hour, "time.Hour"},
+		{time.Minute, "time.Minute"},
+		{time.Second, "time.Second"},
+		{time.Millisecond, "time.Millisecond"},
+	} {
+		if d%unit.d == 0 {
+			return fmt.Sprintf("%d * %v", d/unit.d, unit.name)
+		}
+	}
+	return fmt.Sprintf("time.Duration(%d)", d)
+}
+
+// events returns the Go expression of a list of events.
+func events(names []spec.Name) string {
+	list := make([]string, len(names))
+	for i, name := range names {
+		list[i] = name.Value
+	}
+	return fmt.Sprintf("[]fsm.EventID{%v}", strings.Join(list, ", "))
+}
+
+// header returns the first lines of a generated file.
+func (g *generator) header() string {
+	return fmt.Sprintf("// Code generated by fsmgen from %v. DO NOT EDIT.\n\npackage %v\n\n", g.specFile, g.pkg)
+}
+
+// definition returns the code of the constants, States, Bindings and
+// NewStateMachine.
+func (g *generator) definition() []byte {
+	var b bytes.Buffer
+	c := "*" + g.context
+	b.WriteString(g.header())
+
+	if len(g.timeouts) > 0 {
+		fmt.Fprintf(&b, "import (\n\t\"time\"\n\n\t%q\n)\n\n", fsmPackage)
+	} else {
+		fmt.Fprintf(&b, "import %q\n\n", fsmPackage)
+	}
+
+	b.WriteString("const (\n\t// States\n")
+	for _, s := range g.states {
+		fmt.Fprintf(&b, "\t%v fsm.StateID = %q\n", s, s)
+	}
+	b.WriteString("\n\t// Events\n")
+	for _, e := range g.events {
+		fmt.Fprintf(&b, "\t%v fsm.EventID = %q\n", e, e)
+	}
+	if len(g.timeouts) > 0 {
+		b.WriteString("\n\t// Timeouts\n")
+		for _, s := range g.machine.States {
+			if s.Timeout.Value != "" {
+				// The spec was built already, the timeout is valid.
+				d, _ := time.ParseDuration(s.Timeout.Value)
+				fmt.Fprintf(&b, "\t%v = %v\n", g.timeouts[s.ID.Value], duration(d))
+			}
+		}
+	}
+	b.WriteString(")\n\n")
+
+	fmt.Fprintf(&b, "// States returns the %v definition, a new copy each time.\n", g.machine.Name)
+	fmt.Fprintf(&b, "func States() fsm.States[%v] {\n\treturn fsm.States[%v]{\n", c, c)
+	for _, s := range g.machine.States {
+		fmt.Fprintf(&b, "\t\t%v: {\n", state(s.ID.Value))
+		if s.Action.Value != "" {
+			fmt.Fprintf(&b, "\t\t\tAction: &%v{},\n", s.Action.Value)
+		}
+		if s.OnEnter.Value != "" {
+			fmt.Fprintf(&b, "\t\t\tOnEnter: &%v{},\n", s.OnEnter.Value)
+		}
+		if s.OnExit.Value != "" {
+			fmt.Fprintf(&b, "\t\t\tOnExit: &%v{},\n", s.OnExit.Value)
+		}
+		if s.Parent.Value != "" {
+			fmt.Fprintf(&b, "\t\t\tParent: %v,\n", state(s.Parent.Value))
+		}
+		if s.Initial.Value != "" {
+			fmt.Fprintf(&b, "\t\t\tInitial: %v,\n", state(s.Initial.Value))
+		}
+		if s.Timeout.Value != "" {
+			fmt.Fprintf(&b, "\t\t\tTimeout: %v,\n", g.timeouts[s.ID.Value])
+		}
+		if s.TimeoutEvent.Value != "" {
+			fmt.Fprintf(&b, "\t\t\tTimeoutEvent: %v,\n", s.TimeoutEvent.Value)
+		}
+		if len(s.Emits) > 0 {
+			fmt.Fprintf(&b, "\t\t\tEmits: %v,\n", events(s.Emits))
+		}
+		if len(s.Defer) > 0 {
+			fmt.Fprintf(&b, "\t\t\tDefer: %v,\n", events(s.Defer))
+		}
+		if len(s.Events) > 0 {
+			b.WriteString("\t\t\tEvents: fsm.Events{\n")
+			for _, edge := range s.Events {
+				fmt.Fprintf(&b, "\t\t\t\t%v: %v,\n", edge.Event.Value, state(edge.Target.Value))
+			}
+			b.WriteString("\t\t\t},\n")
+		}
+		if len(s.Transitions) > 0 {
+			fmt.Fprintf(&b, "\t\t\tTransitions: fsm.Transitions[%v]{\n", c)
+			for _, guarded := range s.Transitions {
+				fmt.Fprintf(&b, "\t\t\t\t%v: {\n", guarded.Event.Value)
+				for _, t := range guarded.Transitions {
+					fields := []string{"Target: " + state(t.Target.Value)}
+					if t.Guard.Value != "" {
+						fields = append(fields, "Guard: "+t.Guard.Value)
+					}
+					if t.Action.Value != "" {
+						fields = append(fields, "Action: &"+t.Action.Value+"{}")
+					}
+					fmt.Fprintf(&b, "\t\t\t\t\t{%v},\n", strings.Join(fields, ", "))
+				}
+				b.WriteString("\t\t\t\t},\n")
+			}
+			b.WriteString("\t\t\t},\n")
+		}
+		b.WriteString("\t\t},\n")
+	}
+	b.WriteString("\t}\n}\n\n")
+
+	fmt.Fprintf(&b, "// Bindings returns the actions and guards of the %v definition by name, to\n", g.machine.Name)
+	b.WriteString("// load it with package spec.\n")
+	fmt.Fprintf(&b, "func Bindings() fsm.Bindings[%v] {\n\treturn fsm.Bindings[%v]{\n", c, c)
+	fmt.Fprintf(&b, "\t\tActions: map[string]fsm.Action[%v]{\n", c)
+	for _, a := range g.actions {
+		fmt.Fprintf(&b, "\t\t\t%q: &%v{},\n", a, a)
+	}
+	b.WriteString("\t\t},\n")
+	if len(g.guards) > 0 {
+		fmt.Fprintf(&b, "\t\tGuards: map[string]fsm.Guard[%v]{\n", c)
+		for _, guard := range g.guards {
+			fmt.Fprintf(&b, "\t\t\t%q: %v,\n", guard, guard)
+		}
+		b.WriteString("\t\t},\n")
+	}
+	b.WriteString("\t}\n}\n\n")
+
+	fmt.Fprintf(&b, "// NewStateMachine returns a machine in the DEFAULT state that runs the %v\n", g.machine.Name)
+	b.WriteString("// definition.\n")
+	fmt.Fprintf(&b, "func NewStateMachine() *fsm.StateMachine[%v] {\n", c)
+	fmt.Fprintf(&b, "\treturn &fsm.StateMachine[%v]{\n\t\tCurrent: fsm.Default,\n\t\tPrevious: fsm.Default,\n\t\tStates: States(),\n\t}\n}\n", c)
+
+	return b.Bytes()
+}
+
+// row represents a line of the transition table test.
+type row struct {
+	from, event, to string
+}
+
+// table returns the transitions that can be tested without knowing what the
+// actions and guards do: from a state the machine can rest in, the first one
+// in the spec where the event is handled by the edge, to the state the machine
+// arrives in.
+func (g *generator) table() []row {
+	byID := make(map[string]*spec.State)
+	children := make(map[string]bool)
+	for _, s := range g.machine.States {
+		byID[s.ID.Value] = s
+		children[s.Parent.Value] = true
+	}
+
+	handles := func(s *spec.State, event string) bool {
+		for _, edge := range s.Events {
+			if edge.Event.Value == event {
+				return true
+			}
+		}
+		for _, guarded := range s.Transitions {
+			if guarded.Event.Value == event {
+				return true
+			}
+		}
+		return false
+	}
+
+	// from returns the first leaf that has the event handled by handler.
+	from := func(handler *spec.State, event string) (string, bool) {
+		for _, s := range g.machine.States {
+			if children[s.ID.Value] || s.ID.Value == string(fsm.Any) {
+				continue
+			}
+			for id := s.ID.Value; ; id = byID[id].Parent.Value {
+				if id == "" {
+					if handler.ID.Value == string(fsm.Any) {
+						return s.ID.Value, true
+					}
+					break
+				}
+				if id == handler.ID.Value {
+					return s.ID.Value, true
+				}
+				if handles(byID[id], event) {
+					break
+				}
+			}
+		}
+		return "", false
+	}
+
+	// arrival returns the leaf the machine ends up in when it enters target.
+	arrival := func(target string) string {
+		for byID[target] != nil && byID[target].Initial.Value != "" {
+			target = byID[target].Initial.Value
+		}
+		return target
+	}
+
+	var rows []row
+	for _, s := range g.machine.States {
+		var edges [][2]string
+		for _, edge := range s.Events {
+			edges = append(edges, [2]string{edge.Event.Value, edge.Target.Value})
+		}
+		for _, guarded := range s.Transitions {
+			if first := guarded.Transitions[0]; first.Guard.Value == "" {
+				edges = append(edges, [2]string{guarded.Event.Value, first.Target.Value})
+			}
+		}
+
+		for _, edge := range edges {
+			if leaf, ok := from(s, edge[0]); ok {
+				rows = append(rows, row{from: state(leaf), event: edge[0], to: state(arrival(edge[1]))})
+			}
+		}
+	}
+	return rows
+}
+
+// test returns the code of the transition table test.
+func (g *generator) test() []byte {
+	var b bytes.Buffer
+	name := exported(g.machine.Name)
+	b.WriteString(g.header())
+	fmt.Fprintf(&b, "import (\n\t\"testing\"\n\t\"time\"\n\n\t%q\n)\n\n", fsmPackage)
+
+	fmt.Fprintf(&b, "func Test%vTransitionTable(t *testing.T) {\n\n", name)
+	b.WriteString("\tif err := States().Validate(); err != nil {\n")
+	b.WriteString("\t\tt.Fatalf(\"Validate\\nexpected: <nil>\\ngot:      %v\", err)\n\t}\n\n")
+	b.WriteString("\ttests := []struct {\n\t\tfrom  fsm.StateID\n\t\tevent fsm.EventID\n\t\tto    fsm.StateID\n\t}{\n")
+	for _, r := range g.table() {
+		fmt.Fprintf(&b, "\t\t{%v, %v, %v},\n", r.from, r.event, r.to)
+	}
+	b.WriteString("\t}\n\n")
+	b.WriteString(`	for _, test := range tests {
+		sm := NewStateMachine()
+		sm.Clock = fsm.NewManualClock(time.Time{})
+		sm.Current = test.from
+
+		// The actions can chain more events, the first transition is the one
+		// of the table.
+		var to fsm.StateID
+		sm.AddObserver(fsm.ObserverFunc(func(info fsm.TransitionInfo) {
+			if to == "" {
+				to = info.To
+			}
+		}))
+`)
+	fmt.Fprintf(&b, "\t\tvar ctx %v\n", g.context)
+	b.WriteString(`		sm.SendEvent(test.event, &ctx)
+
+		if to != test.to {
+			t.Errorf("%v on %v\nexpected: %v\ngot:      %v", test.from, test.event, test.to, to)
+		}
+	}
+}
+`)
+	return b.Bytes()
+}
+
+// addStubs adds a stub to the file at path for each action and guard that
+// isn't declared yet, creating the file if need be.
+func (g *generator) addStubs(path string, declared map[string]bool) error {
+	var b bytes.Buffer
+	c := "*" + g.context
+
+	for _, a := range g.actions {
+		if declared[a] {
+			continue
+		}
+		next := "fsm.NoOp"
+		if e, ok := g.emits[a]; ok {
+			next = e
+		}
+		fmt.Fprintf(&b, "\ntype %v struct{}\n\n", a)
+		fmt.Fprintf(&b, "func (a *%v) Execute(ctx %v) fsm.EventID {\n\n\t// TODO: %v\n\n\treturn %v\n}\n", a, c, a, next)
+	}
+	for _, guard := range g.guards {
+		if declared[guard] {
+			continue
+		}
+		fmt.Fprintf(&b, "\nfunc %v(ctx %v, event fsm.Event) bool {\n\n\t// TODO: %v\n\n\treturn true\n}\n", guard, c, guard)
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	src, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		src = []byte(fmt.Sprintf("package %v\n\nimport %q\n", g.pkg, fsmPackage))
+	} else if err != nil {
+		return err
+	}
+	return write(path, append(src, b.Bytes()...))
+}
+
+// exported returns name with its first letter in upper case.
+func exported(name string) string {
+	if name == "" {
+		return "Machine"
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
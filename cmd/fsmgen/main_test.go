@@ -0,0 +1,134 @@
+package main
+
+// To run tests
+// $ go test -v ./...
+//
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const lampContext = `package lamp
+
+type Lamp struct {
+	Lit bool
+}
+`
+
+func TestGenerate(t *testing.T) {
+
+	lampSpec, err := os.ReadFile(filepath.Join("testdata", "lamp.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The package is generated inside the module so that it can import fsm.
+	dir, err := os.MkdirTemp("testdata", "lamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	specPath := filepath.Join(dir, "lamp.yaml")
+	actionsPath := filepath.Join(dir, "lamp_actions.go")
+	write := func(path string, content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(path string) string {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	write(specPath, string(lampSpec))
+	write(filepath.Join(dir, "lamp.go"), lampContext)
+	if err := generate(specPath, "lamp", "Lamp"); err != nil {
+		t.Fatalf("generate\nexpected: <nil>\ngot:      %v", err)
+	}
+
+	generated := read(filepath.Join(dir, "lamp_fsm.go"))
+	if !strings.Contains(generated, "OnTimeout = 5 * time.Minute") || !strings.Contains(generated, "Timeout:      OnTimeout,") {
+		t.Errorf("timeout constant\nexpected: OnTimeout = 5 * time.Minute\ngot:      %v", generated)
+	}
+
+	//
+	// Hand-written bodies survive regenerating, stubs are only added once
+	//
+	actions := read(actionsPath)
+	if !strings.Contains(actions, "// TODO: OnAction") {
+		t.Fatalf("stubs\nexpected: // TODO: OnAction\ngot:      %v", actions)
+	}
+	write(actionsPath, strings.Replace(actions, "// TODO: OnAction", "ctx.Lit = true", 1))
+
+	write(specPath, strings.Replace(string(lampSpec), "    action: OnAction\n", "    action: OnAction\n    onExit: DimAction\n", 1))
+	if err := generate(specPath, "lamp", "Lamp"); err != nil {
+		t.Fatalf("regenerate\nexpected: <nil>\ngot:      %v", err)
+	}
+
+	actions = read(actionsPath)
+	if !strings.Contains(actions, "ctx.Lit = true") || strings.Contains(actions, "// TODO: OnAction") {
+		t.Errorf("hand-written body\nexpected: ctx.Lit = true\ngot:      %v", actions)
+	}
+	for _, decl := range []string{"type OffAction struct", "type OnAction struct", "type DimAction struct", "func Warm("} {
+		if n := strings.Count(actions, decl); n != 1 {
+			t.Errorf("%v\nexpected: 1\ngot:      %v", decl, n)
+		}
+	}
+
+	//
+	// The generated package compiles and passes its transition table test
+	//
+	if testing.Short() {
+		return
+	}
+	gotool := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(gotool); err != nil {
+		t.Skipf("go tool not found: %v", err)
+	}
+	out, err := exec.Command(gotool, "test", "./"+filepath.ToSlash(dir)).CombinedOutput()
+	if err != nil {
+		t.Errorf("go test\nexpected: <nil>\ngot:      %v\n%s", err, out)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+
+	dir := t.TempDir()
+
+	tests := []struct {
+		name string
+		doc  string
+		msg  string
+	}{
+		{
+			name: "missing target",
+			doc:  "states:\n  DEFAULT:\n    action: Count\n    events:\n      Go: Nowhere\n",
+			msg:  `line 5: state "DEFAULT" goes to missing state "Nowhere" on "Go"`,
+		},
+		{
+			name: "timeout conflict",
+			doc:  "states:\n  DEFAULT:\n    action: Count\n    events:\n      Go: Wait\n  Wait:\n    action: Count\n    timeout: 1s\n    timeoutEvent: Go\n    events:\n      Go: WaitTimeout\n  WaitTimeout:\n    action: Count\n    events:\n      Go: DEFAULT\n",
+			msg:  `"WaitTimeout" is both a state and a timeout`,
+		},
+	}
+
+	for _, test := range tests {
+		specPath := filepath.Join(dir, "broken.yaml")
+		if err := os.WriteFile(specPath, []byte(test.doc), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := generate(specPath, "broken", "int")
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%v\nexpected: %v\ngot:      %v", test.name, test.msg, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+// fsmreplay replays a trace of marty events recorded in the field and prints
+// where the replay diverges from the recording, for example
+//
+//	go run ./cmd/fsmreplay street.jsonl
+//
+// With -spec the trace is also replayed against a modified definition, and the
+// counters of both replays are compared
+//
+//	go run ./cmd/fsmreplay -spec pkg/marty/marty.yaml street.jsonl
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/tonygilkerson/marty/pkg/fsm/fsmtrace"
+	"github.com/tonygilkerson/marty/pkg/fsm/spec"
+	"github.com/tonygilkerson/marty/pkg/marty"
+)
+
+func main() {
+	specPath := flag.String("spec", "", "definition to compare with the built-in one")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: fsmreplay [flags] trace\n\nflags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// The machines log every transition, the divergences are what matter here.
+	log.SetOutput(io.Discard)
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	trace, err := fsmtrace.ReadTrace(f)
+	f.Close()
+	if err != nil {
+		fail(err)
+	}
+
+	builtin := marty.New()
+	report("built-in", fsmtrace.Replay(builtin.StateMachine, &builtin.Ctx, trace), builtin)
+
+	if *specPath == "" {
+		return
+	}
+
+	f, err = os.Open(*specPath)
+	if err != nil {
+		fail(err)
+	}
+	states, err := spec.Load(f, marty.Bindings())
+	f.Close()
+	if err != nil {
+		fail(err)
+	}
+
+	modified := marty.NewWithStates(states)
+	report(*specPath, fsmtrace.Replay(modified.StateMachine, &modified.Ctx, trace), modified)
+
+	fmt.Printf("\ncounters, built-in != %v:\n", *specPath)
+	for _, diff := range fsmtrace.DiffContexts(builtin.Ctx, modified.Ctx) {
+		fmt.Printf("  %v\n", diff)
+	}
+}
+
+// report prints the divergences and the counters of a replay.
+func report(name string, divergences []fsmtrace.Divergence, m *marty.Marty) {
+	fmt.Printf("%v: %d divergences\n", name, len(divergences))
+	for _, d := range divergences {
+		fmt.Printf("  %v\n", d)
+	}
+	fmt.Printf("  %v", m.Ctx.String())
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "fsmreplay: %v\n", err)
+	os.Exit(1)
+}
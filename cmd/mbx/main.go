@@ -7,6 +7,9 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/tonygilkerson/marty/pkg/charger"
+	"github.com/tonygilkerson/marty/pkg/door"
+	"github.com/tonygilkerson/marty/pkg/node"
 	"github.com/tonygilkerson/marty/pkg/road"
 	"tinygo.org/x/drivers/sx127x"
 )
@@ -14,6 +17,8 @@ import (
 const (
 	HEARTBEAT_DURATION_SECONDS = 300
 	TXRX_LOOP_TICKER_DURATION_SECONDS = 9
+	MAIL_DEBOUNCE_DURATION_MILLISECONDS = 500 // the photo cell flickers as the door moves
+	MAIL_RECONCILE_DURATION_SECONDS = 60 // the door is checked against the pin this often in case an edge was missed
 )
 
 
@@ -92,24 +97,31 @@ func main() {
 	//
 	// Setup mail
 	//
-	mailInterruptEvents := make(chan string)
+	mailInterruptEvents := make(chan bool, 8)
 	mailPin.Configure(machine.PinConfig{Mode: machine.PinInputPulldown})
 	log.Printf("mailPin status: %v\n", mulePin.Get())
 
-	mailPin.SetInterrupt(machine.PinRising, func(p machine.Pin) {
+	mailPin.SetInterrupt(machine.PinToggle, func(p machine.Pin) {
 
 		// Use non-blocking send so if the channel buffer is full,
-		// the value will get dropped instead of crashing the system
+		// the value will get dropped instead of crashing the system.
+		// Nothing is lost, mailMonitor reads the pin itself once it
+		// gets to the toggles already in the buffer.
 		select {
-		case mailInterruptEvents <- "up":
+		case mailInterruptEvents <- true:
 		default:
 		}
 
 	})
 
+	//
+	// Setup the node, one state machine region for each thing it keeps track of
+	//
+	mbx := node.New(func(msg string) { txQ <- msg })
+
 	// Launch go routines
 
-	go mailMonitor(&mailInterruptEvents, &txQ)
+	go mailMonitor(&mailInterruptEvents, mailPin, mbx)
 	go muleMonitor(&muleInterruptEvents, &txQ)
 	go radio.LoraRxTx()
 
@@ -132,7 +144,8 @@ func main() {
 		//
 		// send charger status
 		//
-		sendChargerStatus(chg, pgood, &txQ)
+		mbx.Send(charger.Reading(chg.Get(), pgood.Get()))
+		log.Printf("node: %v\n", mbx.Configuration())
 
 		//
 		// Send Temperature to Tx queue
@@ -163,17 +176,32 @@ func runLight(led machine.Pin, count int) {
 
 }
 
-func mailMonitor(ch *chan string, txQ *chan string) {
+func mailMonitor(ch *chan bool, mailPin machine.Pin, mbx *node.Node) {
 
-	for range *ch {
-		log.Println("Mailbox light up")
-		*txQ <- "MailboxDoorOpened"
+	reconcile := time.NewTicker(time.Second * MAIL_RECONCILE_DURATION_SECONDS)
 
-		runtime.Gosched()
-		// Wait a long time to give mail man time to shut the door
-		time.Sleep(time.Second * 60)
-		log.Println("Mailbox light down")
+	// The door reports itself left open if the light doesn't go down in time
+	for {
+		select {
+		case <-*ch:
+			// Let the light settle and drop the toggles that came in meanwhile,
+			// the pin says where it ended up
+			time.Sleep(time.Millisecond * MAIL_DEBOUNCE_DURATION_MILLISECONDS)
+			for len(*ch) > 0 {
+				<-*ch
+			}
+		case <-reconcile.C:
+		}
+
+		// The door ignores events that don't change anything, so only the
+		// changes are logged and sent to the gateway
+		if mailPin.Get() {
+			mbx.Send(door.DoorOpened)
+		} else {
+			mbx.Send(door.DoorClosed)
+		}
 
+		runtime.Gosched()
 	}
 
 }
@@ -199,23 +227,3 @@ func sendTemperature(txQ *chan string) {
 	*txQ <- fmt.Sprintf("MailboxTemperature:%v", fahrenheit)
 
 }
-
-func sendChargerStatus(chgPin machine.Pin, pgoodPin machine.Pin, txQ *chan string) {
-
-	if pgoodPin.Get() {
-		log.Println("Power source bad")
-		*txQ <- "ChargerPowerSourceBad"
-	} else {
-		log.Println("Power source good")
-		*txQ <- "ChargerPowerSourceGood"
-	}
-
-	if chgPin.Get() {
-		log.Println("Charger off")
-		*txQ <- "ChargerChargeStatusOff"
-	} else {
-		log.Println("Charger on")
-		*txQ <- "ChargerChargeStatusOn"
-	}
-
-}
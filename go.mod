@@ -6,6 +6,9 @@ go 1.20
 
 // replace tinygo.org/x/drivers v0.24.0 => ../tinygo-org/drivers
 
-require tinygo.org/x/drivers v0.25.0
+require (
+	gopkg.in/yaml.v3 v3.0.1
+	tinygo.org/x/drivers v0.25.0
+)
 
 require github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510 // indirect
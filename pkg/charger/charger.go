@@ -0,0 +1,139 @@
+// Package charger tracks the solar charger from its CHG and PGOOD status pins.
+package charger
+
+import (
+	"github.com/tonygilkerson/marty/pkg/fsm"
+)
+
+const (
+	// States, the charger status is unknown in the default state
+	NoPowerCharging fsm.StateID = "NoPowerCharging"
+	NoPowerCharged  fsm.StateID = "NoPowerCharged"
+	Charging        fsm.StateID = "Charging"
+	Charged         fsm.StateID = "Charged"
+
+	// Events, one for each reading of the status pins
+	PowerBadChargeOn  fsm.EventID = "PowerBadChargeOn"
+	PowerBadChargeOff fsm.EventID = "PowerBadChargeOff"
+	ChargeOn          fsm.EventID = "ChargeOn"
+	ChargeOff         fsm.EventID = "ChargeOff"
+)
+
+type Charger struct {
+	StateMachine *fsm.StateMachine[*Charger]
+
+	// Notify is called with the messages for the gateway
+	Notify func(msg string)
+}
+
+// UnknownAction
+type UnknownAction struct{}
+
+func (a *UnknownAction) Execute(c *Charger) fsm.EventID {
+
+	return fsm.NoOp
+}
+
+// NoPowerChargingAction
+type NoPowerChargingAction struct{}
+
+func (a *NoPowerChargingAction) Execute(c *Charger) fsm.EventID {
+
+	c.Notify("ChargerPowerSourceBad")
+	c.Notify("ChargerChargeStatusOn")
+
+	return fsm.NoOp
+}
+
+// NoPowerChargedAction
+type NoPowerChargedAction struct{}
+
+func (a *NoPowerChargedAction) Execute(c *Charger) fsm.EventID {
+
+	c.Notify("ChargerPowerSourceBad")
+	c.Notify("ChargerChargeStatusOff")
+
+	return fsm.NoOp
+}
+
+// ChargingAction
+type ChargingAction struct{}
+
+func (a *ChargingAction) Execute(c *Charger) fsm.EventID {
+
+	c.Notify("ChargerPowerSourceGood")
+	c.Notify("ChargerChargeStatusOn")
+
+	return fsm.NoOp
+}
+
+// ChargedAction
+type ChargedAction struct{}
+
+func (a *ChargedAction) Execute(c *Charger) fsm.EventID {
+
+	c.Notify("ChargerPowerSourceGood")
+	c.Notify("ChargerChargeStatusOff")
+
+	return fsm.NoOp
+}
+
+// New returns a Charger in the unknown state that calls notify with the
+// messages for the gateway. Every reading is reported, not only changes.
+func New(notify func(msg string)) *Charger {
+
+	c := &Charger{Notify: notify}
+	c.StateMachine = &fsm.StateMachine[*Charger]{
+		Current:  fsm.Default,
+		Previous: fsm.Default,
+		States: fsm.States[*Charger]{
+
+			// A reading leads to the same state whatever the last one was
+			fsm.Any: fsm.State[*Charger]{
+				Events: fsm.Events{
+					PowerBadChargeOn:  NoPowerCharging,
+					PowerBadChargeOff: NoPowerCharged,
+					ChargeOn:          Charging,
+					ChargeOff:         Charged,
+				},
+			},
+
+			fsm.Default: fsm.State[*Charger]{
+				Action: &UnknownAction{},
+			},
+
+			NoPowerCharging: fsm.State[*Charger]{
+				Action: &NoPowerChargingAction{},
+			},
+
+			NoPowerCharged: fsm.State[*Charger]{
+				Action: &NoPowerChargedAction{},
+			},
+
+			Charging: fsm.State[*Charger]{
+				Action: &ChargingAction{},
+			},
+
+			Charged: fsm.State[*Charger]{
+				Action: &ChargedAction{},
+			},
+		},
+	}
+	c.StateMachine.AddObserver(fsm.NewLogObserver("charger"))
+
+	return c
+}
+
+// Reading returns the event for a reading of the status pins, both active low.
+func Reading(chg bool, pgood bool) fsm.EventID {
+	switch {
+	case pgood && chg:
+		return PowerBadChargeOff
+	case pgood:
+		return PowerBadChargeOn
+	case chg:
+		return ChargeOff
+	default:
+		return ChargeOn
+	}
+}
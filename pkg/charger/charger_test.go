@@ -0,0 +1,36 @@
+package charger
+
+// To run tests
+// $ go test -v ./...
+//
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCharger(t *testing.T) {
+
+	var msgs []string
+	c := New(func(msg string) { msgs = append(msgs, msg) })
+
+	if err := c.StateMachine.Validate(); err != nil {
+		t.Errorf("Definition\nexpected: <nil>\ngot:      %v", err)
+	}
+
+	//
+	// Every reading is reported
+	//
+	c.StateMachine.SendEvent(Reading(false, false), c)
+	c.StateMachine.SendEvent(Reading(false, false), c)
+	c.StateMachine.SendEvent(Reading(true, false), c)
+	c.StateMachine.SendEvent(Reading(true, true), c)
+	c.StateMachine.SendEvent(Reading(false, true), c)
+
+	expected := "ChargerPowerSourceGood ChargerChargeStatusOn ChargerPowerSourceGood ChargerChargeStatusOn " +
+		"ChargerPowerSourceGood ChargerChargeStatusOff ChargerPowerSourceBad ChargerChargeStatusOff " +
+		"ChargerPowerSourceBad ChargerChargeStatusOn"
+	if strings.Join(msgs, " ") != expected || c.StateMachine.CurrentState() != NoPowerCharging {
+		t.Errorf("Readings\nexpected: %v %v\ngot:      %v %v", NoPowerCharging, expected, c.StateMachine.CurrentState(), msgs)
+	}
+}
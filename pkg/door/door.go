@@ -0,0 +1,114 @@
+// Package door tracks the mailbox door through the photo cell behind it, which
+// lights up while the door is open.
+package door
+
+import (
+	"time"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+)
+
+const (
+	// States, the door is closed in the default state
+	Open     fsm.StateID = "Open"
+	LeftOpen fsm.StateID = "LeftOpen"
+
+	// Events
+	DoorOpened   fsm.EventID = "DoorOpened"
+	DoorClosed   fsm.EventID = "DoorClosed"
+	DoorLeftOpen fsm.EventID = "DoorLeftOpen"
+
+	// LeftOpenAfter is how long the door can stay open before it is reported as
+	// left open
+	LeftOpenAfter = time.Minute * 10
+
+	// Messages sent to the gateway
+	OpenedMsg   = "MailboxDoorOpened"
+	ClosedMsg   = "MailboxDoorClosed"
+	LeftOpenMsg = "MailboxDoorLeftOpen"
+)
+
+type Door struct {
+	StateMachine *fsm.StateMachine[*Door]
+
+	// Notify is called with the messages for the gateway
+	Notify func(msg string)
+}
+
+// ClosedAction
+type ClosedAction struct{}
+
+func (a *ClosedAction) Execute(d *Door) fsm.EventID {
+
+	d.Notify(ClosedMsg)
+
+	return fsm.NoOp
+}
+
+// OpenAction
+type OpenAction struct{}
+
+func (a *OpenAction) Execute(d *Door) fsm.EventID {
+
+	d.Notify(OpenedMsg)
+
+	// Cancelled by the door closing, since that leaves the Open state
+	d.StateMachine.SendEventAfter(LeftOpenAfter, DoorLeftOpen)
+
+	return fsm.NoOp
+}
+
+// LeftOpenAction
+type LeftOpenAction struct{}
+
+func (a *LeftOpenAction) Execute(d *Door) fsm.EventID {
+
+	d.Notify(LeftOpenMsg)
+
+	return fsm.NoOp
+}
+
+// New returns a closed Door that calls notify with the messages for the gateway.
+// The photo cell flickers, so events that don't change anything, the door
+// opening again while it is open for example, are ignored.
+func New(notify func(msg string)) *Door {
+
+	d := &Door{Notify: notify}
+	d.StateMachine = &fsm.StateMachine[*Door]{
+		Current:  fsm.Default,
+		Previous: fsm.Default,
+		Reject:   fsm.IgnoreRejected,
+		States: fsm.States[*Door]{
+
+			fsm.Default: fsm.State[*Door]{
+				Action: &ClosedAction{},
+				Events: fsm.Events{
+					DoorOpened: Open,
+				},
+			},
+
+			Open: fsm.State[*Door]{
+				Action: &OpenAction{},
+				Events: fsm.Events{
+					DoorClosed:   fsm.Default,
+					DoorLeftOpen: LeftOpen,
+				},
+			},
+
+			LeftOpen: fsm.State[*Door]{
+				Action: &LeftOpenAction{},
+				Events: fsm.Events{
+					DoorClosed: fsm.Default,
+				},
+			},
+		},
+	}
+	d.StateMachine.AddObserver(fsm.NewLogObserver("door"))
+
+	return d
+}
+
+// Send sends an event to the door.
+func (d *Door) Send(event fsm.EventID) error {
+	return d.StateMachine.SendEvent(event, d)
+}
@@ -0,0 +1,57 @@
+package door
+
+// To run tests
+// $ go test -v ./...
+//
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+)
+
+func TestDoor(t *testing.T) {
+
+	var msgs []string
+	clock := fsm.NewManualClock(time.Now())
+	newDoor := func() *Door {
+		msgs = nil
+		d := New(func(msg string) { msgs = append(msgs, msg) })
+		d.StateMachine.Clock = clock
+		return d
+	}
+
+	if err := newDoor().StateMachine.Validate(); err != nil {
+		t.Errorf("Definition\nexpected: <nil>\ngot:      %v", err)
+	}
+
+	//
+	// Mail delivered, the door is closed in time
+	//
+	d := newDoor()
+	d.Send(DoorOpened)
+	d.Send(DoorOpened)
+	clock.Advance(LeftOpenAfter / 2)
+	d.Send(DoorClosed)
+	clock.Advance(LeftOpenAfter)
+
+	expected := "MailboxDoorOpened MailboxDoorClosed"
+	if strings.Join(msgs, " ") != expected || d.StateMachine.CurrentState() != fsm.Default {
+		t.Errorf("Closed in time\nexpected: %v %v\ngot:      %v %v", fsm.Default, expected, d.StateMachine.CurrentState(), msgs)
+	}
+
+	//
+	// Door left open
+	//
+	d = newDoor()
+	d.Send(DoorOpened)
+	clock.Advance(LeftOpenAfter)
+	d.Send(DoorClosed)
+
+	expected = "MailboxDoorOpened MailboxDoorLeftOpen MailboxDoorClosed"
+	if strings.Join(msgs, " ") != expected {
+		t.Errorf("Left open\nexpected: %v\ngot:      %v", expected, msgs)
+	}
+}
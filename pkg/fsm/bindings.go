@@ -0,0 +1,8 @@
+package fsm
+
+// Bindings maps the names used by a declarative definition, such as the ones
+// loaded by package spec, to the actions and guards they stand for.
+type Bindings[C any] struct {
+	Actions map[string]Action[C]
+	Guards  map[string]Guard[C]
+}
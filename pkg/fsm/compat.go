@@ -0,0 +1,19 @@
+package fsm
+
+// The aliases below are the state machine with EventContext as its context
+// type, the way it was before the context type became a parameter. An action
+// with an Execute(EventContext) EventID method is an AnyAction, so definitions
+// written against EventContext keep working once their types are renamed.
+type (
+	AnyAction       = Action[EventContext]
+	AnyState        = State[EventContext]
+	AnyStates       = States[EventContext]
+	AnyStateMachine = StateMachine[EventContext]
+)
+
+// Typed adapts an untyped action for use in a machine with context type C.
+func Typed[C any](action AnyAction) Action[C] {
+	return ActionFunc[C](func(eventCtx C) EventID {
+		return action.Execute(eventCtx)
+	})
+}
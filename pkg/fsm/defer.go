@@ -0,0 +1,71 @@
+package fsm
+
+import "fmt"
+
+// DefaultMaxDeferred is the deferred event queue size used when a StateMachine
+// doesn't set MaxDeferred.
+const DefaultMaxDeferred = 8
+
+// ErrDeferQueueFull is the error an event is rejected with when it should be
+// deferred but the deferred event queue is full. It wraps ErrEventRejected so
+// the machine's Reject policy applies.
+var ErrDeferQueueFull = fmt.Errorf("%w: deferred event queue full", ErrEventRejected)
+
+// deferredEvent is an event waiting for a state that accepts it, along with the
+// context it was sent with.
+type deferredEvent[C any] struct {
+	event    Event
+	eventCtx C
+}
+
+// maxDeferred returns the machine's deferred event queue size.
+func (s *StateMachine[C]) maxDeferred() int {
+	if s.MaxDeferred <= 0 {
+		return DefaultMaxDeferred
+	}
+	return s.MaxDeferred
+}
+
+// deferEvent queues an event the current state rejects if the state, or one of
+// its parents, defers it. It reports whether the event was queued, or returns
+// ErrDeferQueueFull. The caller must hold the mutex.
+func (s *StateMachine[C]) deferEvent(event Event, eventCtx C) (bool, error) {
+	for _, id := range s.states().path(s.Current) {
+		for _, deferred := range s.states()[id].Defer {
+			if deferred != event.ID {
+				continue
+			}
+			if len(s.deferred) >= s.maxDeferred() {
+				return false, ErrDeferQueueFull
+			}
+			s.deferred = append(s.deferred, deferredEvent[C]{event: event, eventCtx: eventCtx})
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// nextDeferred takes the oldest deferred event the current state accepts off
+// the queue, if there is one. The caller must hold the mutex.
+func (s *StateMachine[C]) nextDeferred() (deferredEvent[C], bool) {
+	for i, d := range s.deferred {
+		if _, err := s.getNextState(d.event, d.eventCtx); err == nil {
+			s.deferred = append(s.deferred[:i:i], s.deferred[i+1:]...)
+			return d, true
+		}
+	}
+	return deferredEvent[C]{}, false
+}
+
+// Deferred returns the events waiting for a state that accepts them, oldest
+// first. It must not be called from an action or an observer.
+func (s *StateMachine[C]) Deferred() []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	events := make([]Event, len(s.deferred))
+	for i, d := range s.deferred {
+		events[i] = d.event
+	}
+	return events
+}
@@ -0,0 +1,206 @@
+package fsm
+
+import "sync"
+
+// MachineConfig represents the settings the machines of a Definition start with.
+type MachineConfig struct {
+	Reject        RejectPolicy
+	ErrorState    StateID
+	FailureState  StateID
+	MaxChainDepth int
+	MaxDeferred   int
+}
+
+// Definition represents a validated state machine definition that any number of
+// machines can share. It is a copy of the states it was compiled from, so
+// changing those afterwards doesn't change it, and the machines only ever read
+// it, so they can run concurrently. Actions and guards are shared too, they
+// must not keep state of their own, the context is the place for it.
+type Definition[C any] struct {
+	states States[C]
+	config MachineConfig
+}
+
+// Compile validates the states and the config and returns them as a Definition.
+// The error is a *ValidationError when the definition is broken.
+func Compile[C any](states States[C], config MachineConfig) (*Definition[C], error) {
+	d := &Definition[C]{states: states.clone(), config: config}
+
+	if err := d.NewInstance().Validate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// States returns a copy of the definition's states, for diagrams for example.
+func (d *Definition[C]) States() States[C] {
+	return d.states.clone()
+}
+
+// Version returns the fingerprint of the definition, see States.Version.
+func (d *Definition[C]) Version() string {
+	return d.states.Version()
+}
+
+// NewInstance returns a machine in the Default state that runs the definition.
+// Its States field is nil, the states can't be changed through the machine.
+func (d *Definition[C]) NewInstance() *StateMachine[C] {
+	return &StateMachine[C]{
+		Current:       Default,
+		Previous:      Default,
+		definition:    d,
+		Reject:        d.config.Reject,
+		ErrorState:    d.config.ErrorState,
+		FailureState:  d.config.FailureState,
+		MaxChainDepth: d.config.MaxChainDepth,
+		MaxDeferred:   d.config.MaxDeferred,
+	}
+}
+
+// Definition returns the definition the machine was made from, nil if it wasn't
+// made by Definition.NewInstance.
+func (s *StateMachine[C]) Definition() *Definition[C] {
+	return s.definition
+}
+
+// states returns the states the machine runs, those of its definition if it
+// has one.
+func (s *StateMachine[C]) states() States[C] {
+	if s.definition != nil {
+		return s.definition.states
+	}
+	return s.States
+}
+
+// clone returns a copy of the states that shares nothing with them but the
+// actions and guards.
+func (s States[C]) clone() States[C] {
+	states := make(States[C], len(s))
+	for id, state := range s {
+		if state.Events != nil {
+			events := make(Events, len(state.Events))
+			for event, target := range state.Events {
+				events[event] = target
+			}
+			state.Events = events
+		}
+		if state.Transitions != nil {
+			transitions := make(Transitions[C], len(state.Transitions))
+			for event, candidates := range state.Transitions {
+				transitions[event] = append([]Transition[C](nil), candidates...)
+			}
+			state.Transitions = transitions
+		}
+		if state.Emits != nil {
+			state.Emits = append([]EventID(nil), state.Emits...)
+		}
+		if state.Defer != nil {
+			state.Defer = append([]EventID(nil), state.Defer...)
+		}
+		states[id] = state
+	}
+	return states
+}
+
+// Instance represents a machine of a Registry along with its context.
+type Instance[C any] struct {
+	Machine *StateMachine[C]
+	Context C
+}
+
+// Send sends an event to the machine with the instance's context.
+func (i *Instance[C]) Send(event Event) error {
+	return i.Machine.Send(event, i.Context)
+}
+
+// Registry holds a machine of a Definition for each key, a mailbox node ID for
+// example, creating them on first use. It is safe for concurrent use.
+type Registry[K comparable, C any] struct {
+	definition *Definition[C]
+
+	// setup returns the context of a new machine, it can also add observers to
+	// the machine or set its clock.
+	setup func(key K, machine *StateMachine[C]) C
+
+	mutex     sync.RWMutex
+	instances map[K]*Instance[C]
+}
+
+// NewRegistry returns an empty registry of machines running definition. The
+// context of each machine is returned by setup when the machine is created.
+func NewRegistry[K comparable, C any](definition *Definition[C], setup func(key K, machine *StateMachine[C]) C) *Registry[K, C] {
+	return &Registry[K, C]{
+		definition: definition,
+		setup:      setup,
+		instances:  make(map[K]*Instance[C]),
+	}
+}
+
+// Get returns the instance for key, if there is one.
+func (r *Registry[K, C]) Get(key K) (*Instance[C], bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	instance, ok := r.instances[key]
+	return instance, ok
+}
+
+// Instance returns the instance for key, creating it if there is none.
+func (r *Registry[K, C]) Instance(key K) *Instance[C] {
+	if instance, ok := r.Get(key); ok {
+		return instance
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if instance, ok := r.instances[key]; ok {
+		return instance
+	}
+	machine := r.definition.NewInstance()
+	instance := &Instance[C]{Machine: machine, Context: r.setup(key, machine)}
+	r.instances[key] = instance
+	return instance
+}
+
+// Send sends an event to the instance for key, creating it if there is none.
+func (r *Registry[K, C]) Send(key K, event Event) error {
+	return r.Instance(key).Send(event)
+}
+
+// Remove forgets the instance for key and stops its pending timeouts and the
+// events it scheduled with SendAfter.
+func (r *Registry[K, C]) Remove(key K) {
+	r.mutex.Lock()
+	instance, ok := r.instances[key]
+	delete(r.instances, key)
+	r.mutex.Unlock()
+
+	if ok {
+		machine := instance.Machine
+		machine.mutex.Lock()
+		defer machine.mutex.Unlock()
+		machine.stopAll()
+	}
+}
+
+// Len returns the number of instances.
+func (r *Registry[K, C]) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.instances)
+}
+
+// Each calls f for each instance, in no particular order, until f returns
+// false. The registry can't be changed until Each returns.
+func (r *Registry[K, C]) Each(f func(key K, instance *Instance[C]) bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for key, instance := range r.instances {
+		if !f(key, instance) {
+			return
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package fsm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// edge represents an arrow in a diagram.
+type edge struct {
+	from    StateID
+	to      StateID
+	label   string
+	chained bool
+}
+
+// edges returns the arrows of the definition in a stable order, the ones from
+// Any last. Events a state Emits are marked as chained, including the ones
+// handled by its parents or Any, which get an arrow of their own from the
+// emitting state.
+func (s States[C]) edges() []edge {
+	var edges []edge
+
+	ids := s.ids()
+	if _, ok := s[Any]; ok {
+		ids = append(ids, Any)
+	}
+	for _, id := range ids {
+		state := s[id]
+		emits := make(map[EventID]bool)
+		for _, event := range state.Emits {
+			emits[event] = true
+		}
+
+		for _, event := range sortedEvents(state.Transitions) {
+			for _, t := range state.Transitions[event] {
+				label := string(event)
+				if t.Guard != nil {
+					label += " [guarded]"
+				}
+				edges = append(edges, edge{from: id, to: t.Target, label: label, chained: emits[event]})
+			}
+		}
+		for _, event := range sortedEvents(state.Events) {
+			edges = append(edges, edge{from: id, to: state.Events[event], label: string(event), chained: emits[event]})
+		}
+
+		for _, event := range state.Emits {
+			if _, ok := state.Events[event]; ok {
+				continue
+			}
+			if _, ok := state.Transitions[event]; ok {
+				continue
+			}
+			for _, target := range s.eventTargets(id, event) {
+				edges = append(edges, edge{from: id, to: target, label: string(event), chained: true})
+			}
+		}
+	}
+
+	return edges
+}
+
+// children returns the children of each state, and the top level states under
+// the empty ID, in a stable order.
+func (s States[C]) children() map[StateID][]StateID {
+	children := make(map[StateID][]StateID)
+	for _, id := range s.ids() {
+		parent := s[id].Parent
+		if _, ok := s[parent]; !ok {
+			parent = ""
+		}
+		children[parent] = append(children[parent], id)
+	}
+	return children
+}
+
+// DOT returns the definition as a Graphviz digraph. Parent states are drawn as
+// clusters around their children, events returned by actions as dashed edges,
+// Any as a plain "any state" label and the current state, if any, is filled.
+func (s States[C]) DOT(current StateID) string {
+	var b strings.Builder
+	children := s.children()
+
+	b.WriteString("digraph fsm {\n")
+	b.WriteString("  compound=true;\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, style=rounded];\n")
+	if _, ok := s[Any]; ok {
+		fmt.Fprintf(&b, "  %q [shape=plaintext, label=\"any state\"];\n", Any)
+	}
+
+	var nodes func(parent StateID, indent string)
+	nodes = func(parent StateID, indent string) {
+		for _, id := range children[parent] {
+			if len(children[id]) > 0 {
+				fmt.Fprintf(&b, "%vsubgraph %q {\n", indent, "cluster_"+string(id))
+				fmt.Fprintf(&b, "%v  label=%q;\n", indent, id)
+				nodes(id, indent+"  ")
+				fmt.Fprintf(&b, "%v}\n", indent)
+				continue
+			}
+			if id == current {
+				fmt.Fprintf(&b, "%v%q [style=\"rounded,filled\", fillcolor=lightblue];\n", indent, id)
+			} else {
+				fmt.Fprintf(&b, "%v%q;\n", indent, id)
+			}
+		}
+	}
+	nodes("", "  ")
+
+	// Clusters can't be the end of an edge, so edges to and from a parent state
+	// are drawn to and from one of its leaves, its initial one if it has one, and
+	// clipped at the cluster.
+	anchor := func(id StateID) (StateID, string) {
+		if len(children[id]) == 0 {
+			return id, ""
+		}
+		leaf := id
+		for len(children[leaf]) > 0 {
+			if initial := s[leaf].Initial; initial != "" {
+				leaf = initial
+			} else {
+				leaf = children[leaf][0]
+			}
+		}
+		return leaf, "cluster_" + string(id)
+	}
+
+	for _, e := range s.edges() {
+		from, ltail := anchor(e.from)
+		to, lhead := anchor(e.to)
+
+		attrs := []string{fmt.Sprintf("label=%q", e.label)}
+		if e.chained {
+			attrs = append(attrs, "style=dashed")
+		}
+		if ltail != "" {
+			attrs = append(attrs, fmt.Sprintf("ltail=%q", ltail))
+		}
+		if lhead != "" {
+			attrs = append(attrs, fmt.Sprintf("lhead=%q", lhead))
+		}
+		fmt.Fprintf(&b, "  %q -> %q [%v];\n", from, to, strings.Join(attrs, ", "))
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Mermaid returns the definition as a Mermaid state diagram. Parent states are
+// drawn as composite states and the current state, if any, is highlighted.
+// State diagrams have no dashed arrows, so events returned by actions are
+// labelled as chained instead.
+func (s States[C]) Mermaid(current StateID) string {
+	var b strings.Builder
+	children := s.children()
+
+	b.WriteString("stateDiagram-v2\n")
+	if _, ok := s[Default]; ok {
+		fmt.Fprintf(&b, "  [*] --> %v\n", mermaidID(Default))
+	}
+	if _, ok := s[Any]; ok {
+		fmt.Fprintf(&b, "  state \"any state\" as %v\n", mermaidID(Any))
+	}
+
+	var nodes func(parent StateID, indent string)
+	nodes = func(parent StateID, indent string) {
+		for _, id := range children[parent] {
+			if mermaidID(id) != string(id) {
+				fmt.Fprintf(&b, "%vstate %q as %v\n", indent, id, mermaidID(id))
+			} else if len(children[id]) == 0 {
+				fmt.Fprintf(&b, "%v%v\n", indent, id)
+			}
+			if len(children[id]) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "%vstate %v {\n", indent, mermaidID(id))
+			if initial := s[id].Initial; initial != "" {
+				fmt.Fprintf(&b, "%v  [*] --> %v\n", indent, mermaidID(initial))
+			}
+			nodes(id, indent+"  ")
+			fmt.Fprintf(&b, "%v}\n", indent)
+		}
+	}
+	nodes("", "  ")
+
+	for _, e := range s.edges() {
+		label := e.label
+		if e.chained {
+			label += " (chained)"
+		}
+		fmt.Fprintf(&b, "  %v --> %v : %v\n", mermaidID(e.from), mermaidID(e.to), label)
+	}
+
+	if _, ok := s[current]; ok {
+		b.WriteString("  classDef current fill:#add8e6\n")
+		fmt.Fprintf(&b, "  class %v current\n", mermaidID(current))
+	}
+
+	return b.String()
+}
+
+// mermaidID returns the state ID with the characters Mermaid doesn't allow in
+// an ID replaced.
+func mermaidID(id StateID) string {
+	if id == Any {
+		return "any_state"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, string(id))
+}
@@ -0,0 +1,49 @@
+package fsm
+
+// Event represents an event sent to the state machine along with its payload,
+// the data that only matters to the handling of this one event, such as the
+// time a sensor edge was seen. Events returned by actions and timeout events
+// have no payload.
+type Event struct {
+	ID      EventID
+	Payload interface{}
+}
+
+// EventAction is implemented by actions that read the event that led to them.
+// The machine calls ExecuteEvent instead of Execute on such actions.
+type EventAction[C any] interface {
+	Action[C]
+	ExecuteEvent(eventCtx C, event Event) EventID
+}
+
+// EventActionFunc is an adapter to allow the use of ordinary functions that read
+// the event as actions.
+type EventActionFunc[C any] func(eventCtx C, event Event) EventID
+
+// Execute calls f(eventCtx, Event{}).
+func (f EventActionFunc[C]) Execute(eventCtx C) EventID {
+	return f(eventCtx, Event{})
+}
+
+// ExecuteEvent calls f(eventCtx, event).
+func (f EventActionFunc[C]) ExecuteEvent(eventCtx C, event Event) EventID {
+	return f(eventCtx, event)
+}
+
+// execute runs an action, passing it the event if it reads it.
+func execute[C any](action Action[C], eventCtx C, event Event) EventID {
+	if a, ok := action.(EventAction[C]); ok {
+		return a.ExecuteEvent(eventCtx, event)
+	}
+	return action.Execute(eventCtx)
+}
+
+// Send sends an event and its payload to the state machine. It works like
+// SendEvent, the event is passed to guards, to actions that implement
+// EventAction, to interceptors and to observers.
+func (s *StateMachine[C]) Send(event Event, eventCtx C) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.handler()(event, eventCtx)
+}
@@ -0,0 +1,117 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrActionFailed is matched by the errors reporting an action that failed or
+// panicked.
+var ErrActionFailed = errors.New("action failed")
+
+// ErrActionPanic is matched by the errors reporting an action that panicked.
+var ErrActionPanic = errors.New("action panicked")
+
+// ErrGuardPanic is matched by the errors reporting a guard that panicked.
+var ErrGuardPanic = errors.New("guard panicked")
+
+// ActionFailed is the event the machine enters its FailureState with. Its
+// payload is the *ActionError.
+const ActionFailed EventID = "ActionFailed"
+
+// FallibleAction is implemented by actions that can fail. The machine calls
+// TryExecute instead of ExecuteEvent or Execute on such actions.
+type FallibleAction[C any] interface {
+	Action[C]
+	TryExecute(eventCtx C, event Event) (EventID, error)
+}
+
+// FallibleActionFunc is an adapter to allow the use of ordinary functions that
+// can fail as actions.
+type FallibleActionFunc[C any] func(eventCtx C, event Event) (EventID, error)
+
+// Execute calls f(eventCtx, Event{}) and drops the error, returning NoOp instead.
+func (f FallibleActionFunc[C]) Execute(eventCtx C) EventID {
+	next, err := f(eventCtx, Event{})
+	if err != nil {
+		return NoOp
+	}
+	return next
+}
+
+// TryExecute calls f(eventCtx, event).
+func (f FallibleActionFunc[C]) TryExecute(eventCtx C, event Event) (EventID, error) {
+	return f(eventCtx, event)
+}
+
+// ActionError represents an action that failed, or panicked, while the machine
+// handled Event in State, the state being left, entered or arrived in. A guard
+// that panics is reported the same way, State being the state whose transition
+// it guards. It matches ErrActionFailed and Err with errors.Is.
+type ActionError struct {
+	State StateID
+	Event EventID
+	Err   error
+}
+
+func (e *ActionError) Error() string {
+	return fmt.Sprintf("%v in state %q on %q: %v", ErrActionFailed, e.State, e.Event, e.Err)
+}
+
+// Unwrap returns ErrActionFailed and Err.
+func (e *ActionError) Unwrap() []error {
+	return []error{ErrActionFailed, e.Err}
+}
+
+// FailureRecorder is implemented by contexts that want to know about a failed
+// action before the machine enters its failure state.
+type FailureRecorder interface {
+	RecordFailure(err *ActionError)
+}
+
+// run runs an action with the event, passing the event on if the action reads
+// it, and turns an error or a panic into an *ActionError.
+func run[C any](action Action[C], eventCtx C, event Event, state StateID) (next EventID, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			next = NoOp
+			err = &ActionError{State: state, Event: event.ID, Err: fmt.Errorf("%w: %v", ErrActionPanic, r)}
+		}
+	}()
+
+	if a, ok := action.(FallibleAction[C]); ok {
+		next, err = a.TryExecute(eventCtx, event)
+		if err != nil {
+			return NoOp, &ActionError{State: state, Event: event.ID, Err: err}
+		}
+		return next, nil
+	}
+	return execute(action, eventCtx, event), nil
+}
+
+// check runs a guard, if there is one, and turns a panic into an *ActionError.
+func check[C any](guard Guard[C], eventCtx C, event Event, state StateID) (passed bool, err error) {
+	if guard == nil {
+		return true, nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			passed = false
+			err = &ActionError{State: state, Event: event.ID, Err: fmt.Errorf("%w: %v", ErrGuardPanic, r)}
+		}
+	}()
+
+	return guard(eventCtx, event), nil
+}
+
+// fail applies the machine's FailureState to a failed action. It returns the
+// transition to the failure state, if ok, otherwise the error to return.
+func (s *StateMachine[C]) fail(eventCtx C, failure *ActionError) (transition Transition[C], ok bool, _ error) {
+	if s.FailureState == "" || s.Current == s.FailureState || s.states().isAncestor(s.FailureState, s.Current) {
+		return Transition[C]{}, false, failure
+	}
+	if recorder, ok := any(eventCtx).(FailureRecorder); ok {
+		recorder.RecordFailure(failure)
+	}
+	return Transition[C]{Target: s.FailureState}, true, nil
+}
@@ -4,19 +4,33 @@ package fsm
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"sync"
+	"time"
 )
 
 // ErrEventRejected is the error returned when the state machine cannot process
 // an event in the state that it is in.
 var ErrEventRejected = errors.New("event rejected")
+
+// ErrEventConfig is the error returned when the state machine definition is
+// broken, see States.Validate.
 var ErrEventConfig = errors.New("configuration error")
 
+// ErrGuardRejected is the error returned when the current state has guarded
+// transitions for an event but none of their guards pass. It wraps
+// ErrEventRejected so callers checking for a rejected event still match.
+var ErrGuardRejected = fmt.Errorf("%w: no guard passed", ErrEventRejected)
+
 const (
 	// Default represents the default state of the system.
 	Default StateID = "DEFAULT"
 
+	// Any represents every state of the system. Its events and transitions are
+	// handled in every state that, along with its parents, doesn't handle them
+	// itself. It is not a state the machine can be in.
+	Any StateID = "*"
+
 	// NoOp represents a no-op event.
 	NoOp EventID = "NoOp"
 )
@@ -27,87 +41,374 @@ type StateID string
 // EventID represents an extensible event type in the state machine.
 type EventID string
 
-// EventContext represents the context to be passed to the action implementation.
+// EventContext represents the context to be passed to the action implementation
+// of an untyped machine, see AnyStateMachine.
 type EventContext interface{}
 
-// Action represents the action to be executed in a given state.
-type Action interface {
-	Execute(eventCtx EventContext) EventID
+// Action represents the action to be executed in a given state. C is the type of
+// the context the machine passes to its actions.
+type Action[C any] interface {
+	Execute(eventCtx C) EventID
+}
+
+// ActionFunc is an adapter to allow the use of ordinary functions as actions.
+type ActionFunc[C any] func(eventCtx C) EventID
+
+// Execute calls f(eventCtx).
+func (f ActionFunc[C]) Execute(eventCtx C) EventID {
+	return f(eventCtx)
 }
 
 // Events represents a mapping of events and states.
 type Events map[EventID]StateID
 
+// Guard represents a predicate that must hold for a transition to be taken. It
+// is given the event being handled along with its payload.
+type Guard[C any] func(eventCtx C, event Event) bool
+
+// Transition represents a candidate target state for an event, taken only if
+// its guard passes. A nil guard always passes. Action, if set, runs while the
+// machine moves from the source state to Target.
+type Transition[C any] struct {
+	Target StateID
+	Guard  Guard[C]
+	Action Action[C]
+}
+
+// Transitions represents a mapping of events and their candidate transitions.
+// Candidates are checked in order and the first one whose guard passes wins.
+type Transitions[C any] map[EventID][]Transition[C]
+
 // State binds a state with an action and a set of events it can handle.
-type State struct {
-	Action Action
-	Events Events
+//
+// Transitions are checked before Events, so an entry in Events acts as the
+// fallback target when none of the guarded transitions for the same event pass.
+//
+// OnExit runs when the machine leaves the state and OnEnter when it enters it.
+// Both are for side effects only, the events they return are ignored. Action
+// runs after OnEnter and the event it returns is sent to the machine next.
+//
+// A state with a Parent is nested inside it: events the state rejects bubble up
+// to the parent, and the parent is entered before and exited after its children.
+// A state with an Initial child is a composite state, entering it enters the
+// Initial child in turn. The machine always rests in a state without an Initial
+// child, so only that state's Action runs.
+//
+// A state with a Timeout sends TimeoutEvent to the machine once the machine has
+// been in the state, or in any of its children, for that long.
+//
+// Emits lists the events other than NoOp that Action may return, so that
+// Validate can check the state accepts them.
+//
+// Defer lists events that the state doesn't handle but that must not be lost
+// while the machine is in it, or in one of its children. They are queued and
+// sent again as soon as the machine rests in a state that accepts them.
+type State[C any] struct {
+	Action      Action[C]
+	OnEnter     Action[C]
+	OnExit      Action[C]
+	Events      Events
+	Transitions Transitions[C]
+	Parent      StateID
+	Initial     StateID
+
+	Timeout      time.Duration
+	TimeoutEvent EventID
+
+	Emits []EventID
+	Defer []EventID
 }
 
 // States represents a mapping of states and their implementations.
-type States map[StateID]State
+type States[C any] map[StateID]State[C]
 
-// StateMachine represents the state machine.
-type StateMachine struct {
-	// Previous represents the previous state.
+// StateMachine represents the state machine. C is the type of the context sent
+// with every event and passed on to actions and guards.
+type StateMachine[C any] struct {
+	// Previous represents the previous state. Once events are being sent, read
+	// it with PreviousState.
 	Previous StateID
 
-	// Current represents the current state.
+	// Current represents the current state. Once events are being sent, read it
+	// with CurrentState.
 	Current StateID
 
-	// States holds the configuration of states and events handled by the state machine.
-	States States
+	// States holds the configuration of states and events handled by the state
+	// machine. It is nil for machines made by Definition.NewInstance, they run
+	// the states of their definition.
+	States States[C]
+
+	// Clock drives state timeouts, SystemClock is used when it is nil.
+	Clock Clock
+
+	// MaxChainDepth limits how many transitions one sent event can chain through
+	// actions returning events, DefaultMaxChainDepth is used when it is 0.
+	MaxChainDepth int
+
+	// Reject is what to do with events the current state doesn't handle.
+	Reject RejectPolicy
+
+	// ErrorState is the state the machine enters on a rejected event when Reject
+	// is EnterErrorState.
+	ErrorState StateID
+
+	// MaxDeferred limits how many deferred events can wait for a state that
+	// accepts them, DefaultMaxDeferred is used when it is 0.
+	MaxDeferred int
+
+	// FailureState, if set, is the state the machine enters when an action fails
+	// or panics.
+	FailureState StateID
+
+	// definition is the definition the machine was made from, if any.
+	definition *Definition[C]
 
 	// mutex ensures that only 1 event is processed by the state machine at any given time.
 	mutex sync.Mutex
+
+	// stateMutex guards Current and Previous so that they can be read while an
+	// event is processed, from an action even. Writers also hold mutex.
+	stateMutex sync.RWMutex
+
+	// timers holds the pending timeout of each entered state that has one.
+	timers map[StateID]pendingTimeout
+
+	// entries counts state entries so that a stale timeout can be told apart.
+	entries uint64
+
+	// scheduled holds the events scheduled with SendAfter by the state that
+	// scheduled them, scheduleMutex guards it since actions schedule events.
+	// running is the state whose action is running, if any, the events it
+	// schedules belong to it.
+	scheduled     map[StateID][]*scheduledEvent[C]
+	running       StateID
+	scheduleMutex sync.Mutex
+
+	// eventCtx is the context of the last event, timeouts are sent with it.
+	eventCtx C
+
+	// origin is where the event being handled comes from.
+	origin Origin
+
+	// deferred holds the deferred events, oldest first.
+	deferred []deferredEvent[C]
+
+	// observers are told about every transition.
+	observers []Observer
+
+	// metrics, if any, collects the metrics of the machine.
+	metrics *Metrics
+
+	// interceptors wrap the handling of every event sent to the machine.
+	interceptors []Interceptor[C]
 }
 
-// getNextState returns the next state for the event given the machine's current
-// state, or an error if the event can't be handled in the given state.
-func (s *StateMachine) getNextState(event EventID) (StateID, error) {
-	
-	if state, ok := s.States[s.Current]; ok {
-		if state.Events != nil {
-			if next, ok := state.Events[event]; ok {
-				return next, nil
+// getNextState returns the transition for the event given the machine's current
+// state, or an error if the event can't be handled in the given state. Events
+// the current state rejects bubble up through its parents, then to Any. A guard
+// that panics stops the search with an *ActionError.
+func (s *StateMachine[C]) getNextState(event Event, eventCtx C) (Transition[C], error) {
+
+	guarded := false
+	for _, id := range s.states().handlers(s.Current) {
+		state := s.states()[id]
+
+		candidates, ok := state.Transitions[event.ID]
+		guarded = guarded || ok
+		for _, t := range candidates {
+			passed, err := check(t.Guard, eventCtx, event, id)
+			if err != nil {
+				return Transition[C]{Target: Default}, err
+			}
+			if passed {
+				return t, nil
 			}
 		}
+
+		if next, ok := state.Events[event.ID]; ok {
+			return Transition[C]{Target: next}, nil
+		}
 	}
 
-	return Default, ErrEventRejected
+	if guarded {
+		return Transition[C]{Target: Default}, ErrGuardRejected
+	}
+	return Transition[C]{Target: Default}, ErrEventRejected
 }
 
-// SendEvent sends an event to the state machine.
-func (s *StateMachine) SendEvent(event EventID, eventCtx EventContext) error {
+// SendEvent sends an event without a payload to the state machine, see Send.
+//
+// For each transition the actions run in this order:
+//
+//  1. OnExit of the current state, then of each parent being left, innermost first
+//  2. Action of the transition
+//  3. OnEnter of each state being entered, outermost first, after Current and
+//     Previous are updated
+//  4. Action of the next state
+//
+// States shared by the source and the target, their common ancestors, are
+// neither exited nor entered.
+//
+// If the next state's Action returns an event other than NoOp, that event is
+// sent to the machine in turn before SendEvent returns. A chain longer than
+// MaxChainDepth is stopped with a *LoopError.
+//
+// An event that neither the current state, its parents nor Any handle is
+// deferred if the state or one of its parents defers it. Otherwise it is dealt
+// with according to the machine's Reject policy, by default SendEvent returns
+// ErrEventRejected. Once the machine is at rest the oldest deferred event the
+// new state accepts, if any, is handled before SendEvent returns.
+//
+// An action that returns an error, see FallibleAction, or panics doesn't stop
+// the transition, but the event its state's Action returns is dropped. Once the
+// transition is done the machine enters its FailureState with the ActionFailed
+// event or, if it has none, SendEvent returns the *ActionError. A guard that
+// panics fails the same way, except that there is no transition to finish
+// first, the event goes nowhere.
+//
+// The event is handled through the interceptors registered with Use, and the
+// observers registered with AddObserver are told about each transition.
+func (s *StateMachine[C]) SendEvent(event EventID, eventCtx C) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	return s.handler()(Event{ID: event}, eventCtx)
+}
+
+// sendEvent processes an event, the caller must hold the mutex.
+func (s *StateMachine[C]) sendEvent(event Event, eventCtx C) error {
+	s.eventCtx = eventCtx
+	var chain []ChainStep
+	var forced *Transition[C]
+
 	for {
-		// Determine the next state for the event given the machine's current state.
-		nextState, err := s.getNextState(event)
-		if err != nil {
-			return ErrEventRejected
+		// Determine the next state for the event given the machine's current state,
+		// unless a failed action already did.
+		var transition Transition[C]
+		var err error
+		if forced != nil {
+			transition, forced = *forced, nil
+		} else if transition, err = s.getNextState(event, eventCtx); err != nil {
+			var failure *ActionError
+			if errors.As(err, &failure) {
+				// A guard panicked, the machine goes straight to its failure state.
+				var ok bool
+				if transition, ok, err = s.fail(eventCtx, failure); !ok {
+					return err
+				}
+				event = Event{ID: ActionFailed, Payload: failure}
+			} else {
+				deferred, deferErr := s.deferEvent(event, eventCtx)
+				if deferred {
+					return nil
+				}
+				if deferErr != nil {
+					err = deferErr
+				}
+				s.metrics.reject(event.ID)
+
+				var ok bool
+				if transition, ok, err = s.reject(event.ID, eventCtx, err); !ok {
+					return err
+				}
+			}
 		}
+		now := s.clock().Now()
+		exits, entries := s.states().route(s.Current, transition.Target)
+		nextState := entries[len(entries)-1]
 
 		// Identify the state definition for the next state.
-		state, ok := s.States[nextState]
+		state, ok := s.states()[nextState]
 		if !ok || state.Action == nil {
-			// configuration error
-			// return ErrEventConfig
-			log.Panicf("Configuration error, %+v\n", s.States)
+			return fmt.Errorf("%w: state %q is missing or has no action", ErrEventConfig, nextState)
+		}
+
+		// The transition is carried out even if an action fails, the first failure
+		// is dealt with once it is done.
+		var failure *ActionError
+		try := func(action Action[C], id StateID) EventID {
+			s.runningIn(id)
+			next, err := run(action, eventCtx, event, id)
+			s.runningIn("")
+			if err != nil && failure == nil {
+				failure = err.(*ActionError)
+			}
+			return next
+		}
+
+		// Leave the current state and run the transition's own action. Events they
+		// schedule belong to the state being left, they are cancelled with it.
+		for _, id := range exits {
+			s.stopTimeout(id)
+			s.metrics.exit(id, now)
+			if exit := s.states()[id].OnExit; exit != nil {
+				try(exit, id)
+			}
+		}
+		if transition.Action != nil {
+			try(transition.Action, s.Current)
+		}
+		for _, id := range exits {
+			s.cancelScheduled(id)
 		}
 
 		// Transition over to the next state.
+		s.stateMutex.Lock()
 		s.Previous = s.Current
 		s.Current = nextState
+		s.stateMutex.Unlock()
+
+		for _, id := range entries {
+			s.startTimeout(id)
+			s.metrics.enter(id, now)
+			if enter := s.states()[id].OnEnter; enter != nil {
+				try(enter, id)
+			}
+		}
 
 		// Execute the next state's action and loop over again if the event returned
 		// is not a no-op.
-		nextEvent := state.Action.Execute(eventCtx)
+		nextEvent := try(state.Action, nextState)
+		if failure != nil {
+			nextEvent = NoOp
+		}
+
+		s.notify(TransitionInfo{
+			From:      s.Previous,
+			To:        s.Current,
+			Event:     event.ID,
+			Payload:   event.Payload,
+			Time:      now,
+			NextEvent: nextEvent,
+		})
+		s.metrics.transition(TransitionKey{From: s.Previous, Event: event.ID, To: s.Current})
+
+		if failure != nil {
+			failed, ok, err := s.fail(eventCtx, failure)
+			if !ok {
+				return err
+			}
+			forced = &failed
+			event = Event{ID: ActionFailed, Payload: failure}
+			continue
+		}
 
 		if nextEvent == NoOp {
-			return nil
+			// The machine is at rest, send the oldest deferred event it now accepts.
+			d, ok := s.nextDeferred()
+			if !ok {
+				return nil
+			}
+			event, eventCtx = d.event, d.eventCtx
+			s.eventCtx = eventCtx
+			chain = nil
+			continue
 		}
-		event = nextEvent
+
+		chain = append(chain, ChainStep{Event: event.ID, State: s.Current})
+		if len(chain) >= s.maxChainDepth() {
+			return &LoopError{Chain: chain, Next: nextEvent}
+		}
+		event = Event{ID: nextEvent}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,1524 @@
+package fsm
+
+// To run tests
+// $ go test -v ./...
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countAction counts how many times it is executed and returns next.
+type countAction struct {
+	count int
+	next  EventID
+}
+
+func (a *countAction) Execute(eventCtx EventContext) EventID {
+	a.count += 1
+	if a.next == "" {
+		return NoOp
+	}
+	return a.next
+}
+
+func TestGuardedTransitions(t *testing.T) {
+
+	gap := 0
+	short := func(gap *int, event Event) bool { return *gap < 10 }
+	long := func(gap *int, event Event) bool { return *gap >= 100 }
+
+	newMachine := func() *StateMachine[*int] {
+		return &StateMachine[*int]{
+			Current: Default,
+			States: States[*int]{
+				Default: State[*int]{
+					Action: Typed[*int](&countAction{}),
+					Transitions: Transitions[*int]{
+						"Go": {
+							{Target: "Fast", Guard: short},
+							{Target: "Slow", Guard: long},
+						},
+					},
+				},
+				"Fast": State[*int]{Action: Typed[*int](&countAction{})},
+				"Slow": State[*int]{Action: Typed[*int](&countAction{})},
+			},
+		}
+	}
+
+	//
+	// First guard that passes wins
+	//
+	sm := newMachine()
+	gap = 5
+	if err := sm.SendEvent("Go", &gap); err != nil || sm.Current != "Fast" {
+		t.Errorf("short gap\nexpected: Fast <nil>\ngot:      %v %v", sm.Current, err)
+	}
+
+	sm = newMachine()
+	gap = 500
+	if err := sm.SendEvent("Go", &gap); err != nil || sm.Current != "Slow" {
+		t.Errorf("long gap\nexpected: Slow <nil>\ngot:      %v %v", sm.Current, err)
+	}
+
+	//
+	// No guard passes
+	//
+	sm = newMachine()
+	gap = 50
+	err := sm.SendEvent("Go", &gap)
+	if !errors.Is(err, ErrGuardRejected) || !errors.Is(err, ErrEventRejected) || sm.Current != Default {
+		t.Errorf("no guard passes\nexpected: %v %v\ngot:      %v %v", Default, ErrGuardRejected, sm.Current, err)
+	}
+
+	//
+	// Events is the fallback when no guard passes
+	//
+	sm = newMachine()
+	state := sm.States[Default]
+	state.Events = Events{"Go": "Fallback"}
+	sm.States[Default] = state
+	sm.States["Fallback"] = State[*int]{Action: Typed[*int](&countAction{})}
+	if err := sm.SendEvent("Go", &gap); err != nil || sm.Current != "Fallback" {
+		t.Errorf("fallback\nexpected: Fallback <nil>\ngot:      %v %v", sm.Current, err)
+	}
+}
+
+func TestActionOrder(t *testing.T) {
+
+	var calls []string
+	record := func(name string, next EventID) AnyAction {
+		return ActionFunc[EventContext](func(eventCtx EventContext) EventID {
+			calls = append(calls, name)
+			return next
+		})
+	}
+
+	sm := &AnyStateMachine{
+		Current: Default,
+		States: AnyStates{
+			Default: AnyState{
+				Action: record("Default.Action", NoOp),
+				OnExit: record("Default.OnExit", "Ignored"),
+				Transitions: Transitions[EventContext]{
+					"Go": {{Target: "Busy", Action: record("Default->Busy", "Ignored")}},
+				},
+			},
+			"Busy": AnyState{
+				Action:  record("Busy.Action", "Done"),
+				OnEnter: record("Busy.OnEnter", "Ignored"),
+				OnExit:  record("Busy.OnExit", NoOp),
+				Events:  Events{"Done": Default},
+			},
+		},
+	}
+
+	if err := sm.SendEvent("Go", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"Default.OnExit",
+		"Default->Busy",
+		"Busy.OnEnter",
+		"Busy.Action",
+		"Busy.OnExit",
+		"Default.Action",
+	}
+	if len(calls) != len(expected) {
+		t.Fatalf("action order\nexpected: %v\ngot:      %v", expected, calls)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Fatalf("action order\nexpected: %v\ngot:      %v", expected, calls)
+		}
+	}
+
+	if sm.Current != Default || sm.Previous != "Busy" {
+		t.Errorf("final state\nexpected: %v %v\ngot:      %v %v", Default, "Busy", sm.Current, sm.Previous)
+	}
+}
+
+func TestNestedStates(t *testing.T) {
+
+	var calls []string
+	record := func(name string) AnyAction {
+		return ActionFunc[EventContext](func(eventCtx EventContext) EventID {
+			calls = append(calls, name)
+			return NoOp
+		})
+	}
+	expect := func(name string, expected ...string) {
+		t.Helper()
+		if len(calls) != len(expected) {
+			t.Errorf("%v\nexpected: %v\ngot:      %v", name, expected, calls)
+		} else {
+			for i := range expected {
+				if calls[i] != expected[i] {
+					t.Errorf("%v\nexpected: %v\ngot:      %v", name, expected, calls)
+					break
+				}
+			}
+		}
+		calls = nil
+	}
+
+	sm := &AnyStateMachine{
+		Current: Default,
+		States: AnyStates{
+			Default: AnyState{
+				Action: record("Default"),
+				Events: Events{"Arrive": "Present"},
+			},
+			"Present": AnyState{
+				OnEnter: record("Present.OnEnter"),
+				OnExit:  record("Present.OnExit"),
+				Initial: "A",
+				Events:  Events{"Reset": Default},
+			},
+			"A": AnyState{
+				Parent:  "Present",
+				Action:  record("A"),
+				OnEnter: record("A.OnEnter"),
+				OnExit:  record("A.OnExit"),
+				Events:  Events{"Next": "B"},
+			},
+			"B": AnyState{
+				Parent:  "Present",
+				Action:  record("B"),
+				OnEnter: record("B.OnEnter"),
+				OnExit:  record("B.OnExit"),
+				Events:  Events{"Next": "Present"},
+			},
+		},
+	}
+
+	//
+	// Entering a composite state enters its initial child
+	//
+	sm.SendEvent("Arrive", nil)
+	expect("enter composite", "Present.OnEnter", "A.OnEnter", "A")
+	if sm.Current != "A" {
+		t.Errorf("enter composite\nexpected: A\ngot:      %v", sm.Current)
+	}
+
+	//
+	// Sibling transitions leave the parent alone
+	//
+	sm.SendEvent("Next", nil)
+	expect("sibling", "A.OnExit", "B.OnEnter", "B")
+
+	//
+	// A transition to the parent exits and enters it again
+	//
+	sm.SendEvent("Next", nil)
+	expect("to parent", "B.OnExit", "Present.OnExit", "Present.OnEnter", "A.OnEnter", "A")
+
+	//
+	// Events the child rejects bubble up to the parent
+	//
+	if err := sm.SendEvent("Reset", nil); err != nil {
+		t.Errorf("bubble\nexpected: <nil>\ngot:      %v", err)
+	}
+	expect("bubble", "A.OnExit", "Present.OnExit", "Default")
+	if sm.Current != Default || sm.Previous != "A" {
+		t.Errorf("bubble\nexpected: %v A\ngot:      %v %v", Default, sm.Current, sm.Previous)
+	}
+
+	//
+	// Events nobody handles are still rejected
+	//
+	if err := sm.SendEvent("Next", nil); !errors.Is(err, ErrEventRejected) {
+		t.Errorf("rejected\nexpected: %v\ngot:      %v", ErrEventRejected, err)
+	}
+}
+
+func TestStateTimeout(t *testing.T) {
+
+	clock := NewManualClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	newMachine := func() *AnyStateMachine {
+		return &AnyStateMachine{
+			Current: Default,
+			Clock:   clock,
+			States: AnyStates{
+				Default: AnyState{
+					Action: &countAction{},
+					Events: Events{"Start": "Waiting"},
+				},
+				"Waiting": AnyState{
+					Action:       &countAction{},
+					Timeout:      10 * time.Second,
+					TimeoutEvent: "Timeout",
+					Events:       Events{"Timeout": "TimedOut", "Done": Default},
+				},
+				"TimedOut": AnyState{Action: &countAction{}},
+			},
+		}
+	}
+
+	//
+	// The timeout fires once the clock reaches it
+	//
+	sm := newMachine()
+	sm.SendEvent("Start", nil)
+	clock.Advance(9 * time.Second)
+	if sm.Current != "Waiting" {
+		t.Errorf("before timeout\nexpected: Waiting\ngot:      %v", sm.Current)
+	}
+	clock.Advance(time.Second)
+	if sm.Current != "TimedOut" {
+		t.Errorf("after timeout\nexpected: TimedOut\ngot:      %v", sm.Current)
+	}
+
+	//
+	// Leaving the state cancels the timeout
+	//
+	sm = newMachine()
+	sm.SendEvent("Start", nil)
+	clock.Advance(5 * time.Second)
+	sm.SendEvent("Done", nil)
+	sm.SendEvent("Start", nil)
+	clock.Advance(5 * time.Second)
+	if sm.Current != "Waiting" {
+		t.Errorf("cancelled timeout\nexpected: Waiting\ngot:      %v", sm.Current)
+	}
+	clock.Advance(5 * time.Second)
+	if sm.Current != "TimedOut" {
+		t.Errorf("re-armed timeout\nexpected: TimedOut\ngot:      %v", sm.Current)
+	}
+}
+
+func TestObserversAndInterceptors(t *testing.T) {
+
+	clock := NewManualClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm := &AnyStateMachine{
+		Current: Default,
+		Clock:   clock,
+		States: AnyStates{
+			Default: AnyState{
+				Action: &countAction{},
+				Events: Events{"Go": "Busy"},
+			},
+			"Busy": AnyState{
+				Action: &countAction{next: "Done"},
+				Events: Events{"Done": Default},
+			},
+		},
+	}
+
+	var infos []TransitionInfo
+	sm.AddObserver(ObserverFunc(func(info TransitionInfo) {
+		infos = append(infos, info)
+	}))
+
+	var calls []string
+	trace := func(name string) Interceptor[EventContext] {
+		return func(next Handler[EventContext]) Handler[EventContext] {
+			return func(event Event, eventCtx EventContext) error {
+				calls = append(calls, name+">"+string(event.ID))
+				err := next(event, eventCtx)
+				calls = append(calls, name+"<"+string(event.ID))
+				return err
+			}
+		}
+	}
+	sm.Use(trace("outer"), trace("inner"))
+
+	//
+	// Every transition is observed, chained ones included
+	//
+	sm.SendEvent("Go", nil)
+
+	expected := []TransitionInfo{
+		{From: Default, To: "Busy", Event: "Go", Time: clock.Now(), NextEvent: "Done"},
+		{From: "Busy", To: Default, Event: "Done", Time: clock.Now(), NextEvent: NoOp},
+	}
+	if len(infos) != len(expected) || infos[0] != expected[0] || infos[1] != expected[1] {
+		t.Errorf("observed transitions\nexpected: %+v\ngot:      %+v", expected, infos)
+	}
+
+	//
+	// Interceptors wrap each sent event, the first one registered outermost
+	//
+	expectedCalls := []string{"outer>Go", "inner>Go", "inner<Go", "outer<Go"}
+	if len(calls) != len(expectedCalls) {
+		t.Fatalf("interceptors\nexpected: %v\ngot:      %v", expectedCalls, calls)
+	}
+	for i := range expectedCalls {
+		if calls[i] != expectedCalls[i] {
+			t.Fatalf("interceptors\nexpected: %v\ngot:      %v", expectedCalls, calls)
+		}
+	}
+
+	//
+	// An interceptor can stop an event from being handled
+	//
+	infos = nil
+	sm.Use(func(next Handler[EventContext]) Handler[EventContext] {
+		return func(event Event, eventCtx EventContext) error {
+			return ErrEventRejected
+		}
+	})
+	if err := sm.SendEvent("Go", nil); !errors.Is(err, ErrEventRejected) || len(infos) != 0 {
+		t.Errorf("blocking interceptor\nexpected: %v []\ngot:      %v %+v", ErrEventRejected, err, infos)
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	states := AnyStates{
+		Default: AnyState{
+			Action: &countAction{next: "Again"},
+			Emits:  []EventID{"Again"},
+			Events: Events{"Go": "Busy", "Lost": "Missing"},
+		},
+		"Busy": AnyState{
+			Events:       Events{"Done": Default},
+			Timeout:      time.Second,
+			TimeoutEvent: "Timeout",
+		},
+		"Stuck":  AnyState{Action: &countAction{}},
+		"Orphan": AnyState{Action: &countAction{}, Events: Events{"Done": Default}},
+	}
+
+	err := states.Validate()
+	if !errors.Is(err, ErrEventConfig) {
+		t.Fatalf("broken definition\nexpected: %v\ngot:      %v", ErrEventConfig, err)
+	}
+
+	expected := []string{
+		`state "Busy" has no action`,
+		`state "Busy" times out with event "Timeout" that it does not accept`,
+		`state "DEFAULT" goes to missing state "Missing" on "Lost"`,
+		`state "DEFAULT" action returns event "Again" that it does not accept`,
+		`state "Stuck" is a dead end`,
+		`state "Orphan" is unreachable`,
+		`state "Stuck" is unreachable`,
+	}
+	problems := err.(*ValidationError).Problems
+	if len(problems) != len(expected) {
+		t.Fatalf("problems\nexpected: %q\ngot:      %q", expected, problems)
+	}
+	for i := range expected {
+		if problems[i] != expected[i] {
+			t.Errorf("problem %v\nexpected: %v\ngot:      %v", i, expected[i], problems[i])
+		}
+	}
+
+	locations := err.(*ValidationError).Locations
+	missing := Location{State: Default, Field: "Events", Event: "Lost", Target: "Missing"}
+	if len(locations) != len(expected) || locations[2] != missing || locations[0] != (Location{State: "Busy"}) {
+		t.Errorf("locations\nexpected: %+v at 2\ngot:      %+v", missing, locations)
+	}
+
+	//
+	// SendEvent reports a broken definition instead of panicking
+	//
+	sm := &AnyStateMachine{Current: Default, States: states}
+	if err := sm.SendEvent("Lost", nil); !errors.Is(err, ErrEventConfig) || sm.Current != Default {
+		t.Errorf("missing target\nexpected: %v %v\ngot:      %v %v", Default, ErrEventConfig, sm.Current, err)
+	}
+}
+
+func TestEventLoop(t *testing.T) {
+
+	states := AnyStates{
+		Default: AnyState{
+			Action: &countAction{},
+			Events: Events{"Go": "Ping"},
+		},
+		"Ping": AnyState{
+			Action: &countAction{next: "Bounce"},
+			Emits:  []EventID{"Bounce"},
+			Events: Events{"Bounce": "Pong"},
+		},
+		"Pong": AnyState{
+			Action: &countAction{next: "Bounce"},
+			Emits:  []EventID{"Bounce"},
+			Events: Events{"Bounce": "Ping"},
+		},
+	}
+
+	//
+	// The chain is stopped at MaxChainDepth
+	//
+	sm := &AnyStateMachine{Current: Default, States: states, MaxChainDepth: 5}
+	err := sm.SendEvent("Go", nil)
+
+	var loop *LoopError
+	if !errors.Is(err, ErrEventLoop) || !errors.As(err, &loop) {
+		t.Fatalf("event loop\nexpected: %v\ngot:      %v", ErrEventLoop, err)
+	}
+	if len(loop.Chain) != 5 || loop.Next != "Bounce" {
+		t.Errorf("event loop chain\nexpected: 5 steps then Bounce\ngot:      %v then %v", loop.Chain, loop.Next)
+	}
+	cycle := formatChain(loop.Cycle())
+	if cycle != "Bounce -> Pong, Bounce -> Ping" {
+		t.Errorf("event loop cycle\nexpected: Bounce -> Pong, Bounce -> Ping\ngot:      %v", cycle)
+	}
+
+	//
+	// The same loop is found statically
+	//
+	cycles := states.ChainCycles()
+	if len(cycles) != 1 || formatChain(cycles[0]) != "Bounce -> Pong, Bounce -> Ping" {
+		t.Errorf("chain cycles\nexpected: [Bounce -> Pong, Bounce -> Ping]\ngot:      %v", cycles)
+	}
+	if err := states.Validate(); !errors.Is(err, ErrEventConfig) {
+		t.Errorf("validate loop\nexpected: %v\ngot:      %v", ErrEventConfig, err)
+	}
+}
+
+func TestDiagrams(t *testing.T) {
+
+	states := AnyStates{
+		Default: AnyState{
+			Action: &countAction{},
+			Events: Events{"Go": "Busy"},
+		},
+		"Busy": AnyState{
+			Initial: "Working",
+			Events:  Events{"Stop": Default},
+		},
+		"Working": AnyState{
+			Parent: "Busy",
+			Action: &countAction{next: "Done"},
+			Emits:  []EventID{"Done"},
+			Events: Events{"Done": "Idle now"},
+		},
+		"Idle now": AnyState{
+			Parent: "Busy",
+			Action: &countAction{},
+		},
+	}
+
+	dot := states.DOT("Working")
+	for _, line := range []string{
+		`  subgraph "cluster_Busy" {`,
+		`    "Working" [style="rounded,filled", fillcolor=lightblue];`,
+		`  "DEFAULT" -> "Working" [label="Go", lhead="cluster_Busy"];`,
+		`  "Working" -> "Idle now" [label="Done", style=dashed];`,
+		`  "Working" -> "DEFAULT" [label="Stop", ltail="cluster_Busy"];`,
+	} {
+		if !strings.Contains(dot, line+"\n") {
+			t.Errorf("dot\nexpected line: %v\ngot:\n%v", line, dot)
+		}
+	}
+
+	mermaid := states.Mermaid("Working")
+	for _, line := range []string{
+		`  [*] --> DEFAULT`,
+		`  state Busy {`,
+		`    [*] --> Working`,
+		`    state "Idle now" as Idle_now`,
+		`  DEFAULT --> Busy : Go`,
+		`  Working --> Idle_now : Done (chained)`,
+		`  class Working current`,
+	} {
+		if !strings.Contains(mermaid, line+"\n") {
+			t.Errorf("mermaid\nexpected line: %v\ngot:\n%v", line, mermaid)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+
+	clock := NewManualClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	newMachine := func() *StateMachine[*int] {
+		return &StateMachine[*int]{
+			Current: Default,
+			Clock:   clock,
+			States: States[*int]{
+				Default: State[*int]{
+					Action: Typed[*int](&countAction{}),
+					Events: Events{"Start": "Waiting"},
+				},
+				"Waiting": State[*int]{
+					Action:       Typed[*int](&countAction{}),
+					Timeout:      10 * time.Second,
+					TimeoutEvent: "Timeout",
+					Events:       Events{"Timeout": Default},
+				},
+			},
+		}
+	}
+
+	count := 3
+	sm := newMachine()
+	sm.SendEvent("Start", &count)
+	snap := sm.Snapshot(&count)
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//
+	// A new machine picks up where the old one left off
+	//
+	var restored Snapshot[*int]
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+	sm = newMachine()
+	if err := sm.Restore(restored); err != nil {
+		t.Fatalf("restore\nexpected: <nil>\ngot:      %v", err)
+	}
+	if sm.Current != "Waiting" || sm.Previous != Default || *restored.Context != 3 {
+		t.Errorf("restore\nexpected: Waiting %v 3\ngot:      %v %v %v", Default, sm.Current, sm.Previous, *restored.Context)
+	}
+
+	//
+	// The restored state's timeout is armed again
+	//
+	clock.Advance(10 * time.Second)
+	if sm.Current != Default {
+		t.Errorf("restored timeout\nexpected: %v\ngot:      %v", Default, sm.Current)
+	}
+
+	//
+	// Snapshots of another definition are refused
+	//
+	sm = newMachine()
+	sm.States["Waiting"] = State[*int]{Action: Typed[*int](&countAction{})}
+	if err := sm.Restore(restored); !errors.Is(err, ErrSnapshot) || sm.Current != Default {
+		t.Errorf("other definition\nexpected: %v %v\ngot:      %v %v", Default, ErrSnapshot, sm.Current, err)
+	}
+
+	sm = newMachine()
+	restored.Version = sm.States.Version()
+	restored.Current = "Gone"
+	if err := sm.Restore(restored); !errors.Is(err, ErrSnapshot) {
+		t.Errorf("missing state\nexpected: %v\ngot:      %v", ErrSnapshot, err)
+	}
+
+	sm = newMachine()
+	sm.States[Any] = State[*int]{Events: Events{"Reset": Default}}
+	restored.Version = sm.States.Version()
+	restored.Current = Default
+	restored.Previous = Any
+	if err := sm.Restore(restored); !errors.Is(err, ErrSnapshot) {
+		t.Errorf("previous any\nexpected: %v\ngot:      %v", ErrSnapshot, err)
+	}
+}
+
+func TestAnyState(t *testing.T) {
+
+	states := AnyStates{
+		Any: AnyState{
+			Events: Events{"Reset": Default, "Fault": "Broken"},
+		},
+		Default: AnyState{
+			Action: &countAction{},
+			Events: Events{"Go": "Busy"},
+		},
+		"Busy": AnyState{
+			Action: &countAction{},
+			Events: Events{"Reset": "Busy"},
+		},
+		"Broken": AnyState{
+			Action: &countAction{},
+		},
+	}
+
+	if err := states.Validate(); err != nil {
+		t.Errorf("validate\nexpected: <nil>\ngot:      %v", err)
+	}
+
+	//
+	// Wildcard events apply in every state, the state's own take precedence
+	//
+	sm := &AnyStateMachine{Current: Default, States: states}
+	sm.SendEvent("Go", nil)
+	sm.SendEvent("Reset", nil)
+	if sm.Current != "Busy" || sm.Previous != "Busy" {
+		t.Errorf("override\nexpected: Busy Busy\ngot:      %v %v", sm.Current, sm.Previous)
+	}
+	sm.SendEvent("Fault", nil)
+	sm.SendEvent("Reset", nil)
+	if sm.Current != Default || sm.Previous != "Broken" {
+		t.Errorf("wildcard\nexpected: %v Broken\ngot:      %v %v", Default, sm.Current, sm.Previous)
+	}
+
+	//
+	// Any is not a state
+	//
+	states[Any] = AnyState{Action: &countAction{}, Events: Events{"Fault": "Broken", "Reset": Any}}
+	err := states.Validate()
+	if err == nil {
+		t.Fatalf("validate wildcard\nexpected: %v\ngot:      <nil>", ErrEventConfig)
+	}
+	problems := err.(*ValidationError).Problems
+	if len(problems) != 2 ||
+		problems[0] != `wildcard state "*" can only have events and transitions` ||
+		problems[1] != `state "*" goes to missing state "*" on "Reset"` {
+		t.Errorf("validate wildcard\nexpected: 2 wildcard problems\ngot:      %q", problems)
+	}
+
+	//
+	// Diagrams draw wildcard events from "any state"
+	//
+	states[Any] = AnyState{Events: Events{"Fault": "Broken"}}
+	if dot := states.DOT(""); !strings.Contains(dot, `  "*" -> "Broken" [label="Fault"];`) {
+		t.Errorf("dot\nexpected wildcard edge\ngot:\n%v", dot)
+	}
+	if mermaid := states.Mermaid(""); !strings.Contains(mermaid, `  any_state --> Broken : Fault`) {
+		t.Errorf("mermaid\nexpected wildcard edge\ngot:\n%v", mermaid)
+	}
+}
+
+// rejectCtx records the last rejected event.
+type rejectCtx struct {
+	event EventID
+	from  StateID
+}
+
+func (c *rejectCtx) RecordRejected(event EventID, from StateID) {
+	c.event = event
+	c.from = from
+}
+
+func TestRejectPolicy(t *testing.T) {
+
+	oops := &countAction{}
+	newMachine := func(policy RejectPolicy) *StateMachine[*rejectCtx] {
+		return &StateMachine[*rejectCtx]{
+			Current:    Default,
+			Reject:     policy,
+			ErrorState: "Oops",
+			States: States[*rejectCtx]{
+				Default: State[*rejectCtx]{
+					Action: Typed[*rejectCtx](&countAction{}),
+					Events: Events{"Go": "Busy"},
+				},
+				"Busy": State[*rejectCtx]{
+					Action: Typed[*rejectCtx](&countAction{}),
+					Events: Events{"Done": Default},
+				},
+				"Oops": State[*rejectCtx]{
+					Action: Typed[*rejectCtx](oops),
+					Events: Events{"Reset": Default},
+				},
+			},
+		}
+	}
+
+	//
+	// Rejected events are returned by default
+	//
+	sm := newMachine(ReturnRejected)
+	sm.SendEvent("Go", &rejectCtx{})
+	if err := sm.SendEvent("Go", &rejectCtx{}); !errors.Is(err, ErrEventRejected) || sm.Current != "Busy" {
+		t.Errorf("return\nexpected: Busy %v\ngot:      %v %v", ErrEventRejected, sm.Current, err)
+	}
+
+	//
+	// Or dropped
+	//
+	sm = newMachine(IgnoreRejected)
+	sm.SendEvent("Go", &rejectCtx{})
+	if err := sm.SendEvent("Go", &rejectCtx{}); err != nil || sm.Current != "Busy" {
+		t.Errorf("ignore\nexpected: Busy <nil>\ngot:      %v %v", sm.Current, err)
+	}
+
+	//
+	// Or lead to the error state, which the context is told about
+	//
+	sm = newMachine(EnterErrorState)
+	ctx := &rejectCtx{}
+	sm.SendEvent("Go", ctx)
+	err := sm.SendEvent("Go", ctx)
+	if err != nil || sm.Current != "Oops" || sm.Previous != "Busy" || oops.count != 1 {
+		t.Errorf("error state\nexpected: Oops Busy 1 <nil>\ngot:      %v %v %v %v", sm.Current, sm.Previous, oops.count, err)
+	}
+	if ctx.event != "Go" || ctx.from != "Busy" {
+		t.Errorf("recorded\nexpected: Go Busy\ngot:      %v %v", ctx.event, ctx.from)
+	}
+
+	// The error state doesn't enter itself again
+	if err := sm.SendEvent("Done", ctx); !errors.Is(err, ErrEventRejected) || oops.count != 1 {
+		t.Errorf("rejected in error state\nexpected: 1 %v\ngot:      %v %v", ErrEventRejected, oops.count, err)
+	}
+
+	//
+	// The error state only reached on rejected events is reachable
+	//
+	if err := sm.Validate(); err != nil {
+		t.Errorf("validate\nexpected: <nil>\ngot:      %v", err)
+	}
+	sm.ErrorState = "Missing"
+	err = sm.Validate()
+	if err == nil || err.(*ValidationError).Problems[0] != `error state "Missing" is missing` {
+		t.Errorf("validate missing\nexpected: error state \"Missing\" is missing\ngot:      %v", err)
+	}
+}
+
+// beamEdge is the payload of the events in TestEventPayload.
+type beamEdge struct {
+	Beam string
+	At   int
+}
+
+func TestEventPayload(t *testing.T) {
+
+	var seen []Event
+	read := EventActionFunc[*int](func(last *int, event Event) EventID {
+		seen = append(seen, event)
+		if e, ok := event.Payload.(beamEdge); ok {
+			*last = e.At
+			return "Settled"
+		}
+		return NoOp
+	})
+	near := func(last *int, event Event) bool {
+		e, ok := event.Payload.(beamEdge)
+		return ok && e.Beam == "near"
+	}
+
+	newMachine := func() *StateMachine[*int] {
+		return &StateMachine[*int]{
+			Current: Default,
+			States: States[*int]{
+				Default: State[*int]{
+					Action: Typed[*int](&countAction{}),
+					Transitions: Transitions[*int]{
+						"Rise": {{Target: "Near", Guard: near}, {Target: "Far"}},
+					},
+				},
+				"Near": State[*int]{
+					Action: read,
+					Events: Events{"Settled": "Far"},
+				},
+				"Far": State[*int]{
+					Action: read,
+					Events: Events{"Rise": Default},
+				},
+			},
+		}
+	}
+
+	//
+	// Guards, actions and observers read the payload, chained events have none
+	//
+	last := 0
+	sm := newMachine()
+	var infos []TransitionInfo
+	sm.AddObserver(ObserverFunc(func(info TransitionInfo) {
+		infos = append(infos, info)
+	}))
+	if err := sm.Send(Event{ID: "Rise", Payload: beamEdge{Beam: "near", At: 42}}, &last); err != nil || sm.Current != "Far" {
+		t.Errorf("send\nexpected: Far <nil>\ngot:      %v %v", sm.Current, err)
+	}
+	if last != 42 || len(seen) != 2 || seen[0].Payload != (beamEdge{Beam: "near", At: 42}) || seen[1] != (Event{ID: "Settled"}) {
+		t.Errorf("actions\nexpected: 42 [{Rise {near 42}} {Settled <nil>}]\ngot:      %v %v", last, seen)
+	}
+	if len(infos) != 2 || infos[0].Payload != (beamEdge{Beam: "near", At: 42}) || infos[1].Payload != nil {
+		t.Errorf("observers\nexpected: {near 42} <nil>\ngot:      %+v", infos)
+	}
+
+	sm = newMachine()
+	sm.Send(Event{ID: "Rise", Payload: beamEdge{Beam: "far", At: 7}}, &last)
+	if sm.Current != "Far" || last != 7 {
+		t.Errorf("far beam\nexpected: Far 7\ngot:      %v %v", sm.Current, last)
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+
+	var sm *StateMachine[*int]
+	var seen StateID
+	look := ActionFunc[*int](func(gap *int) EventID {
+		seen = sm.CurrentState()
+		return NoOp
+	})
+	short := func(gap *int, event Event) bool { return *gap < 10 }
+
+	sm = &StateMachine[*int]{
+		Current:  Default,
+		Previous: Default,
+		States: States[*int]{
+			Any: State[*int]{
+				Events: Events{"Reset": Default},
+			},
+			Default: State[*int]{
+				Action: look,
+				Transitions: Transitions[*int]{
+					"Go": {{Target: "Busy", Guard: short}},
+				},
+			},
+			"Present": State[*int]{
+				Events: Events{"Timeout": Default},
+			},
+			"Busy": State[*int]{
+				Parent: "Present",
+				Action: look,
+				Events: Events{"Done": Default},
+			},
+		},
+	}
+
+	//
+	// Events of the state, its parents and Any
+	//
+	if events := sm.AvailableEvents(); len(events) != 2 || events[0] != "Go" || events[1] != "Reset" {
+		t.Errorf("default events\nexpected: [Go Reset]\ngot:      %v", events)
+	}
+
+	//
+	// Guards are checked without moving
+	//
+	gap := 50
+	if sm.CanFire(Event{ID: "Go"}, &gap) || sm.CanFire(Event{ID: "Done"}, &gap) {
+		t.Errorf("can't fire\nexpected: false false\ngot:      %v %v", sm.CanFire(Event{ID: "Go"}, &gap), sm.CanFire(Event{ID: "Done"}, &gap))
+	}
+	gap = 5
+	if !sm.CanFire(Event{ID: "Go"}, &gap) || !sm.CanFire(Event{ID: "Reset"}, &gap) || sm.CurrentState() != Default {
+		t.Errorf("can fire\nexpected: true true %v\ngot:      %v %v %v", Default,
+			sm.CanFire(Event{ID: "Go"}, &gap), sm.CanFire(Event{ID: "Reset"}, &gap), sm.CurrentState())
+	}
+
+	//
+	// Actions can read the live state
+	//
+	sm.SendEvent("Go", &gap)
+	if seen != "Busy" || sm.CurrentState() != "Busy" || sm.PreviousState() != Default {
+		t.Errorf("live state\nexpected: Busy Busy %v\ngot:      %v %v %v", Default, seen, sm.CurrentState(), sm.PreviousState())
+	}
+	events := sm.AvailableEvents()
+	if len(events) != 3 || events[0] != "Done" || events[1] != "Reset" || events[2] != "Timeout" {
+		t.Errorf("busy events\nexpected: [Done Reset Timeout]\ngot:      %v", events)
+	}
+}
+
+func TestDefinition(t *testing.T) {
+
+	count := ActionFunc[*int](func(n *int) EventID {
+		*n += 1
+		return NoOp
+	})
+	states := States[*int]{
+		Default: State[*int]{
+			Action: count,
+			Events: Events{"Go": "Busy"},
+		},
+		"Busy": State[*int]{
+			Action: count,
+			Events: Events{"Done": Default},
+		},
+	}
+
+	//
+	// Broken definitions don't compile
+	//
+	_, err := Compile(states, MachineConfig{Reject: EnterErrorState, ErrorState: "Oops"})
+	if !errors.Is(err, ErrEventConfig) {
+		t.Errorf("compile\nexpected: %v\ngot:      %v", ErrEventConfig, err)
+	}
+
+	//
+	// A definition is a copy
+	//
+	def, err := Compile(states, MachineConfig{Reject: IgnoreRejected})
+	if err != nil {
+		t.Fatal(err)
+	}
+	states[Default].Events["Go"] = "Missing"
+
+	a, b := def.NewInstance(), def.NewInstance()
+	na, nb := 0, 0
+	if err := a.SendEvent("Go", &na); err != nil || a.CurrentState() != "Busy" || b.CurrentState() != Default {
+		t.Errorf("instances\nexpected: Busy %v <nil>\ngot:      %v %v %v", Default, a.CurrentState(), b.CurrentState(), err)
+	}
+	if err := b.SendEvent("Done", &nb); err != nil || nb != 0 {
+		t.Errorf("config\nexpected: 0 <nil>\ngot:      %v %v", nb, err)
+	}
+
+	//
+	// A registry creates a machine per key and can be used concurrently
+	//
+	registry := NewRegistry(def, func(node string, machine *StateMachine[*int]) *int {
+		return new(int)
+	})
+	nodes := []string{"mbx1", "mbx2", "mbx3"}
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(node string) {
+				defer wg.Done()
+				registry.Send(node, Event{ID: "Go"})
+				registry.Send(node, Event{ID: "Done"})
+			}(node)
+		}
+	}
+	wg.Wait()
+
+	if registry.Len() != len(nodes) {
+		t.Errorf("registry\nexpected: %v instances\ngot:      %v", len(nodes), registry.Len())
+	}
+	registry.Each(func(node string, instance *Instance[*int]) bool {
+		// Every Go and every Done that wasn't ignored counts
+		if *instance.Context < 2 || *instance.Context > 40 || *instance.Context%2 != 0 {
+			t.Errorf("%v count\nexpected: even between 2 and 40\ngot:      %v", node, *instance.Context)
+		}
+		return true
+	})
+
+	registry.Remove("mbx1")
+	if _, ok := registry.Get("mbx1"); ok || registry.Len() != 2 {
+		t.Errorf("remove\nexpected: false 2\ngot:      %v %v", ok, registry.Len())
+	}
+
+	//
+	// Instances don't expose the definition's states
+	//
+	if a.States != nil || a.Definition() != def {
+		t.Errorf("instance states\nexpected: nil %p\ngot:      %v %p", def, a.States, a.Definition())
+	}
+
+	//
+	// A removed machine's timeouts and scheduled events are stopped
+	//
+	clock := NewManualClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	var waiting *StateMachine[*int]
+	timed, err := Compile(States[*int]{
+		Default: State[*int]{
+			Action: count,
+			Events: Events{"Go": "Wait"},
+		},
+		"Wait": State[*int]{
+			Action: ActionFunc[*int](func(n *int) EventID {
+				waiting.SendAfter(time.Minute, Event{ID: "Ring"})
+				return NoOp
+			}),
+			Timeout:      time.Hour,
+			TimeoutEvent: "Late",
+			Events:       Events{"Late": Default, "Ring": Default},
+		},
+	}, MachineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	timers := NewRegistry(timed, func(node string, machine *StateMachine[*int]) *int {
+		machine.Clock = clock
+		waiting = machine
+		return new(int)
+	})
+	instance := timers.Instance("mbx1")
+	if err := instance.Send(Event{ID: "Go"}); err != nil {
+		t.Fatal(err)
+	}
+	timers.Remove("mbx1")
+	clock.Advance(time.Hour)
+	if instance.Machine.CurrentState() != "Wait" {
+		t.Errorf("removed\nexpected: Wait\ngot:      %v", instance.Machine.CurrentState())
+	}
+}
+
+// failureCtx records the last failed action.
+type failureCtx struct {
+	failure *ActionError
+}
+
+func (c *failureCtx) RecordFailure(err *ActionError) {
+	c.failure = err
+}
+
+func TestActionFailure(t *testing.T) {
+
+	errSensor := errors.New("sensor stuck")
+	fallible := FallibleActionFunc[*failureCtx](func(ctx *failureCtx, event Event) (EventID, error) {
+		return "Next", errSensor
+	})
+	panicky := ActionFunc[*failureCtx](func(ctx *failureCtx) EventID {
+		var counts map[string]int
+		counts["boom"] += 1
+		return NoOp
+	})
+	broken := &countAction{}
+
+	newMachine := func(failureState StateID) *StateMachine[*failureCtx] {
+		return &StateMachine[*failureCtx]{
+			Current:      Default,
+			FailureState: failureState,
+			States: States[*failureCtx]{
+				Default: State[*failureCtx]{
+					Action: Typed[*failureCtx](&countAction{}),
+					Events: Events{"Go": "Busy", "Boom": "Panicky"},
+				},
+				"Busy": State[*failureCtx]{
+					Action: fallible,
+					Events: Events{"Next": Default},
+				},
+				"Panicky": State[*failureCtx]{
+					Action:  Typed[*failureCtx](&countAction{}),
+					OnEnter: panicky,
+					Events:  Events{"Next": Default},
+				},
+				"Broken": State[*failureCtx]{
+					Action: Typed[*failureCtx](broken),
+					Events: Events{"Go": "Busy"},
+				},
+			},
+		}
+	}
+
+	//
+	// Without a failure state the error is returned once the transition is done
+	//
+	sm := newMachine("")
+	err := sm.SendEvent("Go", &failureCtx{})
+	var actionErr *ActionError
+	if !errors.As(err, &actionErr) || !errors.Is(err, ErrActionFailed) || !errors.Is(err, errSensor) ||
+		actionErr.State != "Busy" || actionErr.Event != "Go" || sm.Current != "Busy" {
+		t.Errorf("action error\nexpected: Busy %v\ngot:      %v %v", errSensor, sm.Current, err)
+	}
+
+	//
+	// Panics are recovered
+	//
+	sm = newMachine("")
+	err = sm.SendEvent("Boom", &failureCtx{})
+	if !errors.Is(err, ErrActionPanic) || !errors.Is(err, ErrActionFailed) || sm.Current != "Panicky" {
+		t.Errorf("panic\nexpected: Panicky %v\ngot:      %v %v", ErrActionPanic, sm.Current, err)
+	}
+
+	//
+	// With a failure state the machine moves there, the error attached
+	//
+	sm = newMachine("Broken")
+	var infos []TransitionInfo
+	sm.AddObserver(ObserverFunc(func(info TransitionInfo) {
+		infos = append(infos, info)
+	}))
+	ctx := &failureCtx{}
+	err = sm.SendEvent("Boom", ctx)
+	if err != nil || sm.Current != "Broken" || broken.count != 1 || !errors.Is(ctx.failure, ErrActionPanic) {
+		t.Errorf("failure state\nexpected: Broken 1 %v <nil>\ngot:      %v %v %v %v", ErrActionPanic, sm.Current, broken.count, ctx.failure, err)
+	}
+	if len(infos) != 2 || infos[1].Event != ActionFailed || infos[1].Payload != ctx.failure {
+		t.Errorf("failure transition\nexpected: %v with the error\ngot:      %+v", ActionFailed, infos)
+	}
+
+	if err := sm.Validate(); err != nil {
+		t.Errorf("validate\nexpected: <nil>\ngot:      %v", err)
+	}
+
+	//
+	// Guards that panic fail like actions, the event goes nowhere
+	//
+	guarded := func(failureState StateID) *StateMachine[*failureCtx] {
+		sm := newMachine(failureState)
+		state := sm.States[Default]
+		state.Transitions = Transitions[*failureCtx]{
+			"Check": {{
+				Target: "Busy",
+				Guard: func(ctx *failureCtx, event Event) bool {
+					var readings []int
+					return readings[3] > 0
+				},
+			}},
+		}
+		sm.States[Default] = state
+		return sm
+	}
+
+	sm = guarded("")
+	err = sm.SendEvent("Check", &failureCtx{})
+	if !errors.As(err, &actionErr) || !errors.Is(err, ErrGuardPanic) || !errors.Is(err, ErrActionFailed) ||
+		actionErr.State != Default || actionErr.Event != "Check" || sm.Current != Default {
+		t.Errorf("guard panic\nexpected: %v %v\ngot:      %v %v", Default, ErrGuardPanic, sm.Current, err)
+	}
+	if sm.CanFire(Event{ID: "Check"}, &failureCtx{}) {
+		t.Errorf("CanFire guard panic\nexpected: false\ngot:      true")
+	}
+
+	sm = guarded("Broken")
+	ctx = &failureCtx{}
+	err = sm.SendEvent("Check", ctx)
+	if err != nil || sm.Current != "Broken" || sm.Previous != Default || !errors.Is(ctx.failure, ErrGuardPanic) {
+		t.Errorf("guard failure state\nexpected: Broken %v <nil>\ngot:      %v %v %v", ErrGuardPanic, sm.Current, ctx.failure, err)
+	}
+}
+
+func TestSendAfter(t *testing.T) {
+
+	clock := NewManualClock(time.Now())
+	var sm *AnyStateMachine
+	schedule := ActionFunc[EventContext](func(eventCtx EventContext) EventID {
+		sm.SendEventAfter(10*time.Minute, "LeftOpen")
+		return NoOp
+	})
+	newMachine := func() *AnyStateMachine {
+		return &AnyStateMachine{
+			Current: Default,
+			Clock:   clock,
+			States: AnyStates{
+				Default: AnyState{
+					Action: &countAction{},
+					Events: Events{"Open": "Open"},
+				},
+				"Open": AnyState{
+					Action: schedule,
+					Events: Events{"Close": Default, "LeftOpen": "LeftOpen", "Wind": "Open"},
+				},
+				"LeftOpen": AnyState{
+					Action: &countAction{},
+					Events: Events{"Close": Default},
+				},
+			},
+		}
+	}
+
+	//
+	// An event scheduled by an action is sent once the delay is over
+	//
+	sm = newMachine()
+	sm.SendEvent("Open", nil)
+	clock.Advance(9 * time.Minute)
+	if sm.CurrentState() != "Open" {
+		t.Errorf("before delay\nexpected: Open\ngot:      %v", sm.CurrentState())
+	}
+	clock.Advance(time.Minute)
+	if sm.CurrentState() != "LeftOpen" {
+		t.Errorf("after delay\nexpected: LeftOpen\ngot:      %v", sm.CurrentState())
+	}
+
+	//
+	// Leaving the state cancels it, re-entering schedules it again
+	//
+	sm = newMachine()
+	sm.SendEvent("Open", nil)
+	clock.Advance(5 * time.Minute)
+	sm.SendEvent("Close", nil)
+	sm.SendEvent("Open", nil)
+	clock.Advance(9 * time.Minute)
+	if sm.CurrentState() != "Open" {
+		t.Errorf("cancelled\nexpected: Open\ngot:      %v", sm.CurrentState())
+	}
+	sm.SendEvent("Wind", nil)
+	clock.Advance(9 * time.Minute)
+	if sm.CurrentState() != "Open" {
+		t.Errorf("self transition\nexpected: Open\ngot:      %v", sm.CurrentState())
+	}
+	clock.Advance(time.Minute)
+	if sm.CurrentState() != "LeftOpen" {
+		t.Errorf("rescheduled\nexpected: LeftOpen\ngot:      %v", sm.CurrentState())
+	}
+
+	//
+	// Or stopping the timer
+	//
+	sm = newMachine()
+	sm.SendEvent("Open", nil)
+	timer := sm.SendEventAfter(time.Minute, "Close")
+	if !timer.Stop() || timer.Stop() {
+		t.Errorf("stop\nexpected: true false\ngot:      false")
+	}
+	clock.Advance(time.Minute)
+	if sm.CurrentState() != "Open" {
+		t.Errorf("stopped\nexpected: Open\ngot:      %v", sm.CurrentState())
+	}
+
+	//
+	// Events scheduled while leaving a state are cancelled with it
+	//
+	sm = newMachine()
+	open := sm.States["Open"]
+	open.OnExit = ActionFunc[EventContext](func(eventCtx EventContext) EventID {
+		sm.SendEventAfter(10*time.Minute, "Open")
+		return NoOp
+	})
+	sm.States["Open"] = open
+	sm.SendEvent("Open", nil)
+	sm.SendEvent("Close", nil)
+	clock.Advance(10 * time.Minute)
+	if sm.CurrentState() != Default {
+		t.Errorf("scheduled on exit\nexpected: %v\ngot:      %v", Default, sm.CurrentState())
+	}
+
+	//
+	// Events a parent schedules on entry last while the machine is in any child
+	//
+	var nested *AnyStateMachine
+	nested = &AnyStateMachine{
+		Current: Default,
+		Clock:   clock,
+		States: AnyStates{
+			Default: AnyState{
+				Action: &countAction{},
+				Events: Events{"Go": "Parent"},
+			},
+			"Parent": AnyState{
+				Initial: "A",
+				OnEnter: ActionFunc[EventContext](func(eventCtx EventContext) EventID {
+					nested.SendEventAfter(time.Minute, "Late")
+					return NoOp
+				}),
+				Events: Events{"Late": Default},
+			},
+			"A": AnyState{
+				Parent: "Parent",
+				Action: &countAction{},
+				Events: Events{"Next": "B"},
+			},
+			"B": AnyState{
+				Parent: "Parent",
+				Action: &countAction{},
+			},
+		},
+	}
+	nested.SendEvent("Go", nil)
+	nested.SendEvent("Next", nil)
+	clock.Advance(time.Minute)
+	if nested.CurrentState() != Default {
+		t.Errorf("scheduled by parent\nexpected: %v\ngot:      %v", Default, nested.CurrentState())
+	}
+}
+
+// node is the context of the machine in TestParallel, each region works on one
+// of its counters.
+type node struct {
+	lights, doors int
+}
+
+func TestParallel(t *testing.T) {
+
+	count := ActionFunc[*int](func(n *int) EventID {
+		*n += 1
+		return NoOp
+	})
+	toggle := func(on, off EventID) *StateMachine[*int] {
+		return &StateMachine[*int]{
+			Current: Default,
+			Reject:  IgnoreRejected,
+			States: States[*int]{
+				Default: State[*int]{Action: count, Events: Events{on: "On"}},
+				"On":    State[*int]{Action: count, Events: Events{off: Default, "Reset": Default}},
+			},
+		}
+	}
+
+	p := NewParallel(
+		NewRegion("light", toggle("LightOn", "LightOff"), func(n *node) *int { return &n.lights }),
+		NewRegion("door", toggle("DoorOpen", "DoorClose"), func(n *node) *int { return &n.doors }),
+	)
+
+	//
+	// Each region only gets its own events
+	//
+	n := &node{}
+	p.SendEvent("LightOn", n)
+	p.SendEvent("DoorOpen", n)
+	p.SendEvent("LightOff", n)
+
+	if config := p.Configuration(); config.String() != "light=DEFAULT door=On" || config.State("door") != "On" {
+		t.Errorf("configuration\nexpected: light=DEFAULT door=On\ngot:      %v", config)
+	}
+	if n.lights != 2 || n.doors != 1 {
+		t.Errorf("contexts\nexpected: 2 1\ngot:      %v %v", n.lights, n.doors)
+	}
+	if events := p.AvailableEvents(); len(events) != 3 || events[0] != "DoorClose" || events[1] != "LightOn" || events[2] != "Reset" {
+		t.Errorf("available events\nexpected: [DoorClose LightOn Reset]\ngot:      %v", events)
+	}
+
+	//
+	// Events shared by regions are broadcast
+	//
+	p.SendEvent("LightOn", n)
+	p.SendEvent("Reset", n)
+	if config := p.Configuration(); config.String() != "light=DEFAULT door=DEFAULT" {
+		t.Errorf("broadcast\nexpected: light=DEFAULT door=DEFAULT\ngot:      %v", config)
+	}
+
+	//
+	// Events no region knows are rejected
+	//
+	if err := p.SendEvent("Nope", n); !errors.Is(err, ErrEventRejected) {
+		t.Errorf("unknown event\nexpected: %v\ngot:      %v", ErrEventRejected, err)
+	}
+}
+
+func TestDeferredEvents(t *testing.T) {
+
+	newStates := func() AnyStates {
+		return AnyStates{
+			Default: AnyState{
+				Action: &countAction{},
+				Events: Events{"Start": "Busy", "Edge": "Seen"},
+			},
+			"Work": AnyState{
+				Initial: "Busy",
+				Defer:   []EventID{"Edge"},
+				Events:  Events{"Done": Default},
+			},
+			"Busy": AnyState{
+				Parent: "Work",
+				Action: &countAction{},
+			},
+			"Seen": AnyState{
+				Action: &countAction{},
+				Events: Events{"Reset": Default},
+			},
+		}
+	}
+
+	//
+	// An event deferred by a parent waits until a state accepts it
+	//
+	sm := &AnyStateMachine{Current: Default, States: newStates()}
+	if err := sm.States.Validate(); err != nil {
+		t.Fatalf("validate\nexpected: <nil>\ngot:      %v", err)
+	}
+	sm.SendEvent("Start", nil)
+	if err := sm.SendEvent("Edge", nil); err != nil || sm.CurrentState() != "Busy" {
+		t.Errorf("deferred\nexpected: Busy <nil>\ngot:      %v %v", sm.CurrentState(), err)
+	}
+	if d := sm.Deferred(); len(d) != 1 || d[0].ID != "Edge" {
+		t.Errorf("queue\nexpected: [Edge]\ngot:      %v", d)
+	}
+	if err := sm.SendEvent("Other", nil); !errors.Is(err, ErrEventRejected) {
+		t.Errorf("not deferred\nexpected: %v\ngot:      %v", ErrEventRejected, err)
+	}
+	if err := sm.SendEvent("Done", nil); err != nil || sm.CurrentState() != "Seen" || sm.PreviousState() != Default {
+		t.Errorf("re-delivered\nexpected: Seen DEFAULT <nil>\ngot:      %v %v %v", sm.CurrentState(), sm.PreviousState(), err)
+	}
+	if d := sm.Deferred(); len(d) != 0 {
+		t.Errorf("drained\nexpected: []\ngot:      %v", d)
+	}
+
+	//
+	// The queue is bounded, events stay queued until a state accepts them
+	//
+	sm = &AnyStateMachine{Current: Default, States: newStates(), MaxDeferred: 2}
+	sm.SendEvent("Start", nil)
+	sm.Send(Event{ID: "Edge", Payload: 1}, nil)
+	sm.Send(Event{ID: "Edge", Payload: 2}, nil)
+	if err := sm.SendEvent("Edge", nil); !errors.Is(err, ErrDeferQueueFull) || !errors.Is(err, ErrEventRejected) {
+		t.Errorf("full\nexpected: %v\ngot:      %v", ErrDeferQueueFull, err)
+	}
+	sm.SendEvent("Done", nil)
+	if d := sm.Deferred(); sm.CurrentState() != "Seen" || len(d) != 1 || d[0].Payload != 2 {
+		t.Errorf("oldest first\nexpected: Seen [Edge 2]\ngot:      %v %v", sm.CurrentState(), d)
+	}
+	sm.SendEvent("Reset", nil)
+	if d := sm.Deferred(); sm.CurrentState() != "Seen" || len(d) != 0 {
+		t.Errorf("second\nexpected: Seen []\ngot:      %v %v", sm.CurrentState(), d)
+	}
+
+	//
+	// Restore drops them
+	//
+	sm.SendEvent("Reset", nil)
+	sm.SendEvent("Start", nil)
+	snap := sm.Snapshot(nil)
+	sm.SendEvent("Edge", nil)
+	if err := sm.Restore(snap); err != nil || len(sm.Deferred()) != 0 {
+		t.Errorf("restore\nexpected: [] <nil>\ngot:      %v %v", sm.Deferred(), err)
+	}
+
+	//
+	// A state can't defer an event it accepts, nor can Any defer events
+	//
+	states := newStates()
+	busy := states["Busy"]
+	busy.Defer = []EventID{"Done"}
+	states["Busy"] = busy
+	states[Any] = AnyState{Defer: []EventID{"Start"}}
+	err := states.Validate()
+	if err == nil || !strings.Contains(err.Error(), `state "Busy" defers event "Done" that it accepts`) ||
+		!strings.Contains(err.Error(), `"*"`) {
+		t.Errorf("validate\nexpected: Busy and Any errors\ngot:      %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	clock := NewManualClock(time.Now())
+	sm := &AnyStateMachine{
+		Current: Default,
+		Clock:   clock,
+		States: AnyStates{
+			Default: AnyState{
+				Action: &countAction{},
+				Events: Events{"Go": "Busy"},
+			},
+			"Work": AnyState{
+				Initial: "Busy",
+				Events:  Events{"Done": Default},
+			},
+			"Busy": AnyState{
+				Parent: "Work",
+				Action: &countAction{},
+				Events: Events{"Again": "Busy"},
+			},
+		},
+	}
+	metrics := sm.CollectMetrics(time.Second, time.Minute)
+	start := clock.Now()
+
+	//
+	// Entries, dwell times, transitions and rejected events are counted
+	//
+	clock.Advance(2 * time.Minute)
+	sm.SendEvent("Go", nil)
+	clock.Advance(500 * time.Millisecond)
+	sm.SendEvent("Again", nil)
+	clock.Advance(10 * time.Second)
+	sm.SendEvent("Done", nil)
+	sm.SendEvent("Done", nil)
+
+	snap := metrics.Snapshot()
+	if !snap.Since.Equal(start) {
+		t.Errorf("since\nexpected: %v\ngot:      %v", start, snap.Since)
+	}
+	expected := map[StateID]StateMetrics{
+		Default: {Entries: 1, Visits: 1, Dwell: 2 * time.Minute, Histogram: []int{0, 0, 1}},
+		"Work":  {Entries: 1, Visits: 1, Dwell: 10500 * time.Millisecond, Histogram: []int{0, 1, 0}},
+		"Busy":  {Entries: 2, Visits: 2, Dwell: 10500 * time.Millisecond, Histogram: []int{1, 1, 0}},
+	}
+	for id, want := range expected {
+		got := snap.States[id]
+		if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", want) {
+			t.Errorf("%v metrics\nexpected: %+v\ngot:      %+v", id, want, got)
+		}
+	}
+	transitions := map[TransitionKey]int{
+		{From: Default, Event: "Go", To: "Busy"}:   1,
+		{From: "Busy", Event: "Again", To: "Busy"}: 1,
+		{From: "Busy", Event: "Done", To: Default}: 1,
+	}
+	if len(snap.Transitions) != len(transitions) {
+		t.Errorf("transitions\nexpected: %v\ngot:      %v", transitions, snap.Transitions)
+	}
+	for key, count := range transitions {
+		if snap.Transitions[key] != count {
+			t.Errorf("transition %+v\nexpected: %v\ngot:      %v", key, count, snap.Transitions[key])
+		}
+	}
+	if len(snap.Rejected) != 1 || snap.Rejected["Done"] != 1 {
+		t.Errorf("rejected\nexpected: map[Done:1]\ngot:      %v", snap.Rejected)
+	}
+
+	//
+	// Reset returns the metrics and starts them over
+	//
+	clock.Advance(time.Second)
+	if reset := metrics.Reset(); reset.Transitions[TransitionKey{From: Default, Event: "Go", To: "Busy"}] != 1 {
+		t.Errorf("reset\nexpected: the metrics so far\ngot:      %+v", reset)
+	}
+	clock.Advance(time.Second)
+	sm.SendEvent("Go", nil)
+	snap = metrics.Snapshot()
+	if !snap.Since.Equal(start.Add(2*time.Minute+11500*time.Millisecond)) ||
+		len(snap.Transitions) != 1 || len(snap.Rejected) != 0 || snap.States[Default].Dwell != 2*time.Second {
+		t.Errorf("after reset\nexpected: 1 transition, Default for 2s\ngot:      %+v", snap)
+	}
+}
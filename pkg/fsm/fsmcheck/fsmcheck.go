@@ -0,0 +1,241 @@
+// Package fsmcheck explores fsm definitions exhaustively, for tests.
+//
+// Explore sends every event in every state a machine can reach, up to a depth,
+// and checks invariants after each event:
+//
+//	err := fsmcheck.Explore(fsmcheck.Config[*marty.Context]{
+//		New: func() (*fsm.StateMachine[*marty.Context], *marty.Context) {
+//			return marty.Definition().NewInstance(), &marty.Context{}
+//		},
+//		Invariants: []fsmcheck.Invariant[*marty.Context]{{
+//			Name: "no more vehicles than resets",
+//			Holds: func(state fsm.StateID, ctx *marty.Context) bool {
+//				return ctx.ArrivedCount+ctx.DepartedCount+ctx.FalseAlarmCount <= ctx.DefaultCount
+//			},
+//		}},
+//	})
+//
+// The machines are explored breadth first, so the event sequence reported when
+// an invariant fails is one of the shortest that breaks it.
+package fsmcheck
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+)
+
+// DefaultDepth is the number of events Explore sends in a row when the Config
+// doesn't set Depth.
+const DefaultDepth = 8
+
+// Invariant represents a property that must hold in every state the machine
+// can reach.
+type Invariant[C any] struct {
+	Name  string
+	Holds func(state fsm.StateID, eventCtx C) bool
+}
+
+// Config represents what Explore explores.
+type Config[C any] struct {
+	// New returns a machine in its initial state along with its context. It is
+	// called for every event sequence Explore tries, so it must return a new
+	// context each time. Machines without a Clock are given a fsm.ManualClock
+	// so that their timeouts never fire, timeout events are sent like any other.
+	New func() (*fsm.StateMachine[C], C)
+
+	// Events are the events sent in every state, by default every event the
+	// states of the machine handle.
+	Events []fsm.EventID
+
+	// Depth is the number of events sent in a row, DefaultDepth is used when it
+	// is 0.
+	Depth int
+
+	Invariants []Invariant[C]
+
+	// Key returns what identifies a state of the machine, states with the same
+	// key are only explored once. By default it is the current state, the
+	// deferred events and the context, formatted with %+v.
+	Key func(machine *fsm.StateMachine[C], eventCtx C) string
+}
+
+// Counterexample represents an event sequence that breaks an invariant, or
+// that leads to an error other than a rejected event. States holds the state
+// the machine starts in and the state it is in after each event.
+type Counterexample struct {
+	Invariant string
+	Events    []fsm.EventID
+	States    []fsm.StateID
+	Err       error
+}
+
+func (c *Counterexample) Error() string {
+	path := make([]string, len(c.States))
+	for i, state := range c.States {
+		path[i] = string(state)
+	}
+
+	var b strings.Builder
+	if c.Err != nil {
+		fmt.Fprintf(&b, "%v", c.Err)
+	} else {
+		fmt.Fprintf(&b, "invariant %q does not hold", c.Invariant)
+	}
+	fmt.Fprintf(&b, " after %v: %v", c.Events, strings.Join(path, " -> "))
+	return b.String()
+}
+
+// Unwrap returns Err.
+func (c *Counterexample) Unwrap() error {
+	return c.Err
+}
+
+// Report represents what Explore went through: the distinct states it reached,
+// the events they accepted and how many events it sent in a row at most.
+type Report struct {
+	States      int
+	Transitions int
+	Depth       int
+}
+
+// Explore checks the invariants in every state of the machine that the events
+// reach within the depth. It returns a *Counterexample, one of the shortest,
+// when an invariant doesn't hold or an event fails with an error other than
+// fsm.ErrEventRejected. Rejected events are not explored any further.
+func Explore[C any](config Config[C]) (Report, error) {
+	var report Report
+
+	depth := config.Depth
+	if depth <= 0 {
+		depth = DefaultDepth
+	}
+	key := config.Key
+	if key == nil {
+		key = defaultKey[C]
+	}
+
+	events := config.Events
+	if events == nil {
+		machine, _ := config.New()
+		states := machine.States
+		if definition := machine.Definition(); definition != nil {
+			states = definition.States()
+		}
+		events = alphabet(states)
+	}
+
+	machine, eventCtx := start(config)
+	initial := machine.CurrentState()
+	if c := check(config.Invariants, machine, eventCtx); c != nil {
+		c.States = []fsm.StateID{initial}
+		return report, c
+	}
+
+	type path struct {
+		events []fsm.EventID
+		states []fsm.StateID
+	}
+	seen := map[string]bool{key(machine, eventCtx): true}
+	frontier := []path{{states: []fsm.StateID{initial}}}
+	report.States = 1
+
+	for level := 1; level <= depth && len(frontier) > 0; level++ {
+		report.Depth = level
+
+		var next []path
+		for _, p := range frontier {
+			for _, event := range events {
+				sequence := append(append([]fsm.EventID(nil), p.events...), event)
+
+				machine, eventCtx, err := replay(config, sequence)
+				if errors.Is(err, fsm.ErrEventRejected) {
+					continue
+				}
+				states := append(append([]fsm.StateID(nil), p.states...), machine.CurrentState())
+				if err != nil {
+					return report, &Counterexample{Events: sequence, States: states, Err: err}
+				}
+				report.Transitions++
+
+				k := key(machine, eventCtx)
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+				report.States++
+
+				if c := check(config.Invariants, machine, eventCtx); c != nil {
+					c.Events, c.States = sequence, states
+					return report, c
+				}
+				next = append(next, path{events: sequence, states: states})
+			}
+		}
+		frontier = next
+	}
+
+	return report, nil
+}
+
+// start returns a new machine from the config, with a clock that never moves.
+func start[C any](config Config[C]) (*fsm.StateMachine[C], C) {
+	machine, eventCtx := config.New()
+	if machine.Clock == nil {
+		machine.Clock = fsm.NewManualClock(time.Time{})
+	}
+	return machine, eventCtx
+}
+
+// replay sends the events to a new machine, stopping at the first error.
+func replay[C any](config Config[C], events []fsm.EventID) (*fsm.StateMachine[C], C, error) {
+	machine, eventCtx := start(config)
+	for _, event := range events {
+		if err := machine.SendEvent(event, eventCtx); err != nil {
+			return machine, eventCtx, err
+		}
+	}
+	return machine, eventCtx, nil
+}
+
+// check returns the first invariant that doesn't hold, if any.
+func check[C any](invariants []Invariant[C], machine *fsm.StateMachine[C], eventCtx C) *Counterexample {
+	for _, invariant := range invariants {
+		if !invariant.Holds(machine.CurrentState(), eventCtx) {
+			return &Counterexample{Invariant: invariant.Name}
+		}
+	}
+	return nil
+}
+
+func defaultKey[C any](machine *fsm.StateMachine[C], eventCtx C) string {
+	return fmt.Sprintf("%v %v %+v", machine.CurrentState(), machine.Deferred(), eventCtx)
+}
+
+// alphabet returns every event the states handle, in a stable order.
+func alphabet[C any](states fsm.States[C]) []fsm.EventID {
+	seen := make(map[fsm.EventID]bool)
+	var events []fsm.EventID
+	add := func(event fsm.EventID) {
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+
+	for _, state := range states {
+		for event := range state.Events {
+			add(event)
+		}
+		for event := range state.Transitions {
+			add(event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	return events
+}
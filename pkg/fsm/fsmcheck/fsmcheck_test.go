@@ -0,0 +1,85 @@
+package fsmcheck
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+)
+
+// visits counts how many times the machine arrived in B.
+type visits struct {
+	count int
+}
+
+func newMachine(broken bool) func() (*fsm.StateMachine[*visits], *visits) {
+	return func() (*fsm.StateMachine[*visits], *visits) {
+		noop := fsm.ActionFunc[*visits](func(v *visits) fsm.EventID { return fsm.NoOp })
+		b := fsm.FallibleActionFunc[*visits](func(v *visits, event fsm.Event) (fsm.EventID, error) {
+			v.count += 1
+			if broken && v.count > 1 {
+				return fsm.NoOp, fmt.Errorf("count %v", v.count)
+			}
+			return fsm.NoOp, nil
+		})
+
+		machine := &fsm.StateMachine[*visits]{
+			Current: fsm.Default,
+			States: fsm.States[*visits]{
+				fsm.Default: {Action: noop, Events: fsm.Events{"Go": "A"}},
+				"A":         {Action: noop, Events: fsm.Events{"Go": "B", "Back": fsm.Default}},
+				"B":         {Action: b, Events: fsm.Events{"Back": fsm.Default}},
+			},
+		}
+		return machine, &visits{}
+	}
+}
+
+func TestExplore(t *testing.T) {
+
+	//
+	// Every state is explored, rejected events are not
+	//
+	report, err := Explore(Config[*visits]{New: newMachine(false), Depth: 4})
+	if err != nil {
+		t.Fatalf("explore\nexpected: <nil>\ngot:      %v", err)
+	}
+	// DEFAULT and A with a count of 0 and 1, B with a count of 1
+	if report.States != 5 || report.Transitions != 5 || report.Depth != 4 {
+		t.Errorf("report\nexpected: {States:5 Transitions:5 Depth:4}\ngot:      %+v", report)
+	}
+
+	//
+	// The counterexample is one of the shortest
+	//
+	_, err = Explore(Config[*visits]{
+		New: newMachine(false),
+		Invariants: []Invariant[*visits]{
+			{Name: "B once", Holds: func(state fsm.StateID, v *visits) bool { return v.count <= 1 }},
+		},
+	})
+	var c *Counterexample
+	if !errors.As(err, &c) || c.Invariant != "B once" ||
+		!reflect.DeepEqual(c.Events, []fsm.EventID{"Go", "Go", "Back", "Go", "Go"}) ||
+		!reflect.DeepEqual(c.States, []fsm.StateID{fsm.Default, "A", "B", fsm.Default, "A", "B"}) {
+		t.Errorf("counterexample\nexpected: B once [Go Go Back Go Go]\ngot:      %v", err)
+	}
+
+	//
+	// Or the first to fail
+	//
+	_, err = Explore(Config[*visits]{New: newMachine(true)})
+	if !errors.As(err, &c) || !errors.Is(err, fsm.ErrActionFailed) || len(c.Events) != 5 {
+		t.Errorf("failure\nexpected: %v after 5 events\ngot:      %v", fsm.ErrActionFailed, err)
+	}
+
+	//
+	// The events can be chosen
+	//
+	report, err = Explore(Config[*visits]{New: newMachine(false), Events: []fsm.EventID{"Go"}})
+	if err != nil || report.States != 3 || report.Depth != 3 {
+		t.Errorf("events\nexpected: {States:3 Depth:3} <nil>\ngot:      %+v %v", report, err)
+	}
+}
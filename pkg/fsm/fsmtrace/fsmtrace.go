@@ -0,0 +1,228 @@
+// Package fsmtrace records the events sent to fsm state machines and replays
+// them, for debugging on a host what a machine did in the field:
+//
+//	recorder := fsmtrace.Record(machine, f)
+//	...
+//	trace, err := fsmtrace.ReadTrace(f)
+//	divergences := fsmtrace.Replay(marty.New().StateMachine, &marty.Context{}, trace)
+//
+// It is kept out of the fsm package so that firmware using fsm doesn't carry
+// encoding/json and reflect.
+package fsmtrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+)
+
+// TraceEntry represents an event sent to a state machine and the state it left
+// the machine in. The short JSON keys keep a trace of field data small.
+type TraceEntry struct {
+	Time  time.Time   `json:"t"`
+	Event fsm.EventID `json:"e"`
+	State fsm.StateID `json:"s"`
+
+	// Payload is the payload of the event as JSON, if it has one.
+	Payload json.RawMessage `json:"p,omitempty"`
+
+	// Timeout is set when the event was sent by a state timeout, Scheduled when
+	// it was scheduled with SendAfter.
+	Timeout   bool `json:"to,omitempty"`
+	Scheduled bool `json:"sch,omitempty"`
+
+	// Err is the error the machine returned for the event, if any.
+	Err string `json:"err,omitempty"`
+}
+
+// Recorder writes the events sent to a state machine to a trace, one JSON line
+// per event, see Record.
+type Recorder struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+	err   error
+}
+
+// Err returns the first error writing the trace, recording stops after it.
+func (r *Recorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.err
+}
+
+// write appends an entry to the trace, along with the payload of its event.
+func (r *Recorder) write(entry TraceEntry, payload interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	if payload != nil {
+		if entry.Payload, r.err = json.Marshal(payload); r.err != nil {
+			return
+		}
+	}
+	r.err = r.enc.Encode(entry)
+}
+
+// Record writes every event sent to the machine from now on to w, including the
+// ones sent by state timeouts and SendAfter, so that they can be replayed with
+// Replay. Payloads are written as JSON. Events chained by actions are not
+// written, replaying sends them again.
+func Record[C any](s *fsm.StateMachine[C], w io.Writer) *Recorder {
+	r := &Recorder{enc: json.NewEncoder(w)}
+
+	s.Use(func(next fsm.Handler[C]) fsm.Handler[C] {
+		return func(event fsm.Event, eventCtx C) error {
+			clock := s.Clock
+			if clock == nil {
+				clock = fsm.SystemClock
+			}
+			origin := s.EventOrigin()
+			entry := TraceEntry{
+				Time:      clock.Now(),
+				Event:     event.ID,
+				Timeout:   origin == fsm.OriginTimeout,
+				Scheduled: origin == fsm.OriginScheduled,
+			}
+			err := next(event, eventCtx)
+			entry.State = s.Current
+			if err != nil {
+				entry.Err = err.Error()
+			}
+			r.write(entry, event.Payload)
+			return err
+		}
+	})
+
+	return r
+}
+
+// ReadTrace reads a trace written by a Recorder.
+func ReadTrace(r io.Reader) ([]TraceEntry, error) {
+	var trace []TraceEntry
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry TraceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		trace = append(trace, entry)
+	}
+
+	return trace, scanner.Err()
+}
+
+// Divergence represents a recorded event after which a replay left the machine
+// in a different state, or with a different error, than the recording did.
+type Divergence struct {
+	// Index is the position of the event in the trace.
+	Index int
+	Entry TraceEntry
+	State fsm.StateID
+	Err   string
+}
+
+func (d Divergence) String() string {
+	s := fmt.Sprintf("#%d %v: recorded %v, replayed %v", d.Index, d.Entry.Event, d.Entry.State, d.State)
+	if d.Entry.Err != d.Err {
+		s += fmt.Sprintf(", recorded error %q, replayed error %q", d.Entry.Err, d.Err)
+	}
+	return s
+}
+
+// PayloadDecoder turns the payload of a recorded event back into the value the
+// actions and guards of the machine expect.
+type PayloadDecoder func(event fsm.EventID, payload json.RawMessage) (interface{}, error)
+
+// Replay is ReplayWith without a PayloadDecoder, the payloads of the events are
+// sent as json.RawMessage.
+func Replay[C any](s *fsm.StateMachine[C], eventCtx C, trace []TraceEntry) []Divergence {
+	return ReplayWith(s, eventCtx, trace, nil)
+}
+
+// ReplayWith sends the events of a trace to the machine with eventCtx, in order,
+// and returns where it diverges from the recording. The machine, which should be
+// in its initial state and not running yet, is given a fsm.ManualClock that
+// starts at the time of the first event and is advanced to the time of each
+// event before it is sent. Timeout and scheduled events in the trace are not
+// sent, the machine's own timeouts and scheduled events fire as the clock moves
+// instead, so a definition with different timeouts can be replayed against the
+// same trace. Payloads are decoded with decode, an event whose payload can't be
+// decoded is sent without one.
+func ReplayWith[C any](s *fsm.StateMachine[C], eventCtx C, trace []TraceEntry, decode PayloadDecoder) []Divergence {
+	if len(trace) == 0 {
+		return nil
+	}
+
+	clock := fsm.NewManualClock(trace[0].Time)
+	s.Clock = clock
+
+	var divergences []Divergence
+	for i, entry := range trace {
+		if d := entry.Time.Sub(clock.Now()); d > 0 {
+			clock.Advance(d)
+		}
+
+		var errText string
+		if !entry.Timeout && !entry.Scheduled {
+			event := fsm.Event{ID: entry.Event}
+			if len(entry.Payload) > 0 {
+				event.Payload = entry.Payload
+				if decode != nil {
+					event.Payload, _ = decode(entry.Event, entry.Payload)
+				}
+			}
+			if err := s.Send(event, eventCtx); err != nil {
+				errText = err.Error()
+			}
+		} else {
+			errText = entry.Err
+		}
+
+		current := s.CurrentState()
+		if current != entry.State || errText != entry.Err {
+			divergences = append(divergences, Divergence{Index: i, Entry: entry, State: current, Err: errText})
+		}
+	}
+
+	return divergences
+}
+
+// DiffContexts compares the exported fields of two contexts, or of the structs
+// they point to, and describes each field that differs, in field order.
+// Contexts that aren't structs are compared as a whole.
+func DiffContexts(want, got interface{}) []string {
+	wv, gv := reflect.Indirect(reflect.ValueOf(want)), reflect.Indirect(reflect.ValueOf(got))
+	if !wv.IsValid() || !gv.IsValid() || wv.Kind() != reflect.Struct || wv.Type() != gv.Type() {
+		if !reflect.DeepEqual(want, got) {
+			return []string{fmt.Sprintf("%+v != %+v", want, got)}
+		}
+		return nil
+	}
+
+	var diffs []string
+	for i := 0; i < wv.NumField(); i++ {
+		field := wv.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		w, g := wv.Field(i).Interface(), gv.Field(i).Interface()
+		if !reflect.DeepEqual(w, g) {
+			diffs = append(diffs, fmt.Sprintf("%v: %+v != %+v", field.Name, w, g))
+		}
+	}
+	return diffs
+}
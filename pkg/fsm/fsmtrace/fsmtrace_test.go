@@ -0,0 +1,231 @@
+package fsmtrace
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+)
+
+// countAction counts how many times it is executed.
+type countAction struct {
+	count int
+}
+
+func (a *countAction) Execute(eventCtx fsm.EventContext) fsm.EventID {
+	a.count += 1
+	return fsm.NoOp
+}
+
+func TestTraceReplay(t *testing.T) {
+
+	newMachine := func(timeout time.Duration) (*fsm.AnyStateMachine, *countAction) {
+		done := &countAction{}
+		return &fsm.AnyStateMachine{
+			Current: fsm.Default,
+			States: fsm.AnyStates{
+				fsm.Default: fsm.AnyState{
+					Action: &countAction{},
+					Events: fsm.Events{"Go": "Wait"},
+				},
+				"Wait": fsm.AnyState{
+					Action:       &countAction{},
+					Timeout:      timeout,
+					TimeoutEvent: "Late",
+					Events:       fsm.Events{"Late": fsm.Default, "Done": "Done"},
+				},
+				"Done": fsm.AnyState{
+					Action: done,
+					Events: fsm.Events{"Go": "Wait"},
+				},
+			},
+		}, done
+	}
+
+	//
+	// Every event is recorded, timeouts included
+	//
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := fsm.NewManualClock(start)
+	sm, _ := newMachine(10 * time.Second)
+	sm.Clock = clock
+
+	var trace strings.Builder
+	recorder := Record(sm, &trace)
+	sm.SendEvent("Go", nil)
+	clock.Advance(10 * time.Second)
+	sm.SendEvent("Go", nil)
+	clock.Advance(5 * time.Second)
+	sm.SendEvent("Done", nil)
+	sm.SendEvent("Done", nil)
+
+	if recorder.Err() != nil {
+		t.Fatal(recorder.Err())
+	}
+	entries, err := ReadTrace(strings.NewReader(trace.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TraceEntry{
+		{Time: start, Event: "Go", State: "Wait"},
+		{Time: start.Add(10 * time.Second), Event: "Late", State: fsm.Default, Timeout: true},
+		{Time: start.Add(10 * time.Second), Event: "Go", State: "Wait"},
+		{Time: start.Add(15 * time.Second), Event: "Done", State: "Done"},
+		{Time: start.Add(15 * time.Second), Event: "Done", State: "Done", Err: fsm.ErrEventRejected.Error()},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("trace\nexpected: %v\ngot:      %v", expected, entries)
+	}
+	for i := range expected {
+		if !entries[i].Time.Equal(expected[i].Time) || entries[i].Event != expected[i].Event ||
+			entries[i].State != expected[i].State || entries[i].Timeout != expected[i].Timeout || entries[i].Err != expected[i].Err {
+			t.Errorf("trace entry %d\nexpected: %+v\ngot:      %+v", i, expected[i], entries[i])
+		}
+	}
+
+	//
+	// Replaying against the same definition doesn't diverge
+	//
+	replayed, done := newMachine(10 * time.Second)
+	if divergences := Replay(replayed, nil, entries); len(divergences) != 0 || done.count != 1 {
+		t.Errorf("same definition\nexpected: [] 1\ngot:      %v %v", divergences, done.count)
+	}
+
+	//
+	// A longer timeout never fires so the second Go is rejected
+	//
+	replayed, _ = newMachine(time.Minute)
+	divergences := Replay(replayed, nil, entries)
+	if len(divergences) != 2 || divergences[0].Index != 1 || divergences[0].State != "Wait" ||
+		divergences[1].Index != 2 || divergences[1].Err != fsm.ErrEventRejected.Error() {
+		t.Errorf("longer timeout\nexpected: #1 Wait, #2 %v\ngot:      %v", fsm.ErrEventRejected, divergences)
+	}
+
+	//
+	// Events scheduled with SendAfter are recorded, and not sent twice on replay
+	//
+	newDoor := func() *fsm.AnyStateMachine {
+		var door *fsm.AnyStateMachine
+		door = &fsm.AnyStateMachine{
+			Current: fsm.Default,
+			States: fsm.AnyStates{
+				fsm.Default: fsm.AnyState{
+					Action: &countAction{},
+					Events: fsm.Events{"Open": "Open"},
+				},
+				"Open": fsm.AnyState{
+					Action: fsm.ActionFunc[fsm.EventContext](func(eventCtx fsm.EventContext) fsm.EventID {
+						door.SendEventAfter(time.Minute, "LeftOpen")
+						return fsm.NoOp
+					}),
+					Events: fsm.Events{"Close": fsm.Default, "LeftOpen": "LeftOpen"},
+				},
+				"LeftOpen": fsm.AnyState{
+					Action: &countAction{},
+					Events: fsm.Events{"Close": fsm.Default},
+				},
+			},
+		}
+		return door
+	}
+
+	clock = fsm.NewManualClock(start)
+	sm = newDoor()
+	sm.Clock = clock
+	trace.Reset()
+	Record(sm, &trace)
+	sm.SendEvent("Open", nil)
+	clock.Advance(time.Minute)
+	sm.SendEvent("Close", nil)
+
+	entries, err = ReadTrace(strings.NewReader(trace.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[1].Event != "LeftOpen" || !entries[1].Scheduled || entries[1].Timeout {
+		t.Fatalf("scheduled trace\nexpected: Open, LeftOpen scheduled, Close\ngot:      %+v", entries)
+	}
+	if divergences := Replay(newDoor(), nil, entries); len(divergences) != 0 {
+		t.Errorf("scheduled replay\nexpected: []\ngot:      %v", divergences)
+	}
+
+	//
+	// Contexts are diffed field by field
+	//
+	type counts struct {
+		A, B, C int
+	}
+	diffs := DiffContexts(&counts{1, 2, 3}, &counts{1, 5, 4})
+	if len(diffs) != 2 || diffs[0] != "B: 2 != 5" || diffs[1] != "C: 3 != 4" {
+		t.Errorf("diff\nexpected: [B: 2 != 5 C: 3 != 4]\ngot:      %q", diffs)
+	}
+}
+
+// beamEdge is the payload of the events in TestPayloadReplay.
+type beamEdge struct {
+	Beam string
+	At   int
+}
+
+func TestPayloadReplay(t *testing.T) {
+
+	newMachine := func() *fsm.StateMachine[*int] {
+		read := fsm.EventActionFunc[*int](func(last *int, event fsm.Event) fsm.EventID {
+			if e, ok := event.Payload.(beamEdge); ok {
+				*last = e.At
+			}
+			return fsm.NoOp
+		})
+		return &fsm.StateMachine[*int]{
+			Current: fsm.Default,
+			States: fsm.States[*int]{
+				fsm.Default: fsm.State[*int]{
+					Action: fsm.Typed[*int](&countAction{}),
+					Events: fsm.Events{"Rise": "Risen"},
+				},
+				"Risen": fsm.State[*int]{
+					Action: read,
+					Events: fsm.Events{"Rise": fsm.Default},
+				},
+			},
+		}
+	}
+
+	//
+	// Payloads are recorded and decoded on replay
+	//
+	last := 0
+	var trace strings.Builder
+	sm := newMachine()
+	sm.Clock = fsm.NewManualClock(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+	Record(sm, &trace)
+	sm.Send(fsm.Event{ID: "Rise", Payload: beamEdge{Beam: "near", At: 42}}, &last)
+	if !strings.Contains(trace.String(), `"p":{"Beam":"near","At":42}`) {
+		t.Errorf("recorded payload\nexpected: {\"Beam\":\"near\",\"At\":42}\ngot:      %v", trace.String())
+	}
+
+	entries, err := ReadTrace(strings.NewReader(trace.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last = 0
+	divergences := ReplayWith(newMachine(), &last, entries, func(event fsm.EventID, payload json.RawMessage) (interface{}, error) {
+		var e beamEdge
+		err := json.Unmarshal(payload, &e)
+		return e, err
+	})
+	if len(divergences) != 0 || last != 42 {
+		t.Errorf("replay\nexpected: [] 42\ngot:      %v %v", divergences, last)
+	}
+
+	//
+	// Without a decoder payloads are sent as raw JSON
+	//
+	last = 0
+	divergences = Replay(newMachine(), &last, entries)
+	if len(divergences) != 0 || last != 0 {
+		t.Errorf("raw replay\nexpected: [] 0\ngot:      %v %v", divergences, last)
+	}
+}
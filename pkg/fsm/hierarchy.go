@@ -0,0 +1,86 @@
+package fsm
+
+// path returns the state followed by its parents, innermost first. It stops at
+// the first parent that is missing or already visited so that a broken
+// definition can't loop forever.
+func (s States[C]) path(id StateID) []StateID {
+	var path []StateID
+	seen := make(map[StateID]bool)
+
+	for id != "" && !seen[id] {
+		seen[id] = true
+		path = append(path, id)
+
+		state, ok := s[id]
+		if !ok {
+			break
+		}
+		id = state.Parent
+	}
+
+	return path
+}
+
+// handlers returns the states whose events apply in the given state: the state,
+// its parents, innermost first, and Any if it is defined.
+func (s States[C]) handlers(id StateID) []StateID {
+	handlers := s.path(id)
+	if _, ok := s[Any]; ok && id != Any {
+		handlers = append(handlers, Any)
+	}
+	return handlers
+}
+
+// initial follows the Initial children of a composite state down to the state
+// the machine rests in, which is returned last. The given state comes first.
+func (s States[C]) initial(id StateID) []StateID {
+	chain := []StateID{id}
+	seen := map[StateID]bool{id: true}
+
+	for {
+		next := s[id].Initial
+		if next == "" || seen[next] {
+			return chain
+		}
+		seen[next] = true
+		chain = append(chain, next)
+		id = next
+	}
+}
+
+// route returns the states to exit, innermost first, and the states to enter,
+// outermost first, to move from the source to the target. Common ancestors of
+// the two are left alone, while a target that is the source itself or one of
+// its ancestors is exited and entered again. The last state to enter is the one
+// the machine rests in.
+func (s States[C]) route(source, target StateID) (exits []StateID, entries []StateID) {
+
+	targetPath := s.path(target)
+	shared := make(map[StateID]bool, len(targetPath))
+	for _, id := range targetPath[1:] {
+		shared[id] = true
+	}
+
+	var common StateID
+	for _, id := range s.path(source) {
+		if shared[id] {
+			common = id
+			break
+		}
+		exits = append(exits, id)
+	}
+
+	n := len(targetPath)
+	for i, id := range targetPath {
+		if id == common {
+			n = i
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		entries = append(entries, targetPath[i])
+	}
+	entries = append(entries, s.initial(target)[1:]...)
+
+	return exits, entries
+}
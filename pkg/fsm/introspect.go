@@ -0,0 +1,62 @@
+package fsm
+
+import "sort"
+
+// CurrentState returns the current state. It is safe to call at any time, from
+// an action or an observer too.
+func (s *StateMachine[C]) CurrentState() StateID {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+
+	return s.Current
+}
+
+// PreviousState returns the previous state. It is safe to call at any time,
+// from an action or an observer too.
+func (s *StateMachine[C]) PreviousState() StateID {
+	s.stateMutex.RLock()
+	defer s.stateMutex.RUnlock()
+
+	return s.Previous
+}
+
+// AvailableEvents returns the events the current state, its parents and Any
+// handle, in a stable order. Events with guarded transitions are included even
+// if none of their guards would pass, see CanFire. It is safe to call at any
+// time, from an action or an observer too.
+func (s *StateMachine[C]) AvailableEvents() []EventID {
+	seen := make(map[EventID]bool)
+	var events []EventID
+	add := func(event EventID) {
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+
+	for _, id := range s.states().handlers(s.CurrentState()) {
+		state := s.states()[id]
+		for event := range state.Transitions {
+			add(event)
+		}
+		for event := range state.Events {
+			add(event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	return events
+}
+
+// CanFire reports whether the current state would accept the event, checking
+// the guards with eventCtx, without running any action. It doesn't take the
+// machine's Reject policy into account, a rejected event is one it can't fire.
+// CanFire waits for the event being processed, if any, so it must not be called
+// from an action or an observer.
+func (s *StateMachine[C]) CanFire(event Event, eventCtx C) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.getNextState(event, eventCtx)
+	return err == nil
+}
@@ -0,0 +1,131 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultMaxChainDepth is the chain depth used when a StateMachine doesn't set
+// MaxChainDepth.
+const DefaultMaxChainDepth = 32
+
+// ErrEventLoop is matched by the errors reporting a chain of events that doesn't
+// end.
+var ErrEventLoop = errors.New("event loop")
+
+// ChainStep represents an event and the state the machine moved to because of it.
+type ChainStep struct {
+	Event EventID
+	State StateID
+}
+
+func (c ChainStep) String() string {
+	return fmt.Sprintf("%v -> %v", c.Event, c.State)
+}
+
+// LoopError is the error returned by SendEvent when actions keep returning
+// events past the machine's MaxChainDepth. The machine is left in the last
+// state of the chain and Next is not sent.
+type LoopError struct {
+	Chain []ChainStep
+	Next  EventID
+}
+
+// Cycle returns the repeating tail of the chain, or the whole chain when no
+// step repeats.
+func (e *LoopError) Cycle() []ChainStep {
+	last := len(e.Chain) - 1
+	for i := last - 1; i >= 0; i-- {
+		if e.Chain[i] == e.Chain[last] {
+			return e.Chain[i+1:]
+		}
+	}
+	return e.Chain
+}
+
+func (e *LoopError) Error() string {
+	return fmt.Sprintf("%v: %v chained transitions, cycle %v", ErrEventLoop, len(e.Chain), formatChain(e.Cycle()))
+}
+
+// Unwrap returns ErrEventLoop.
+func (e *LoopError) Unwrap() error {
+	return ErrEventLoop
+}
+
+// maxChainDepth returns the machine's chain depth limit.
+func (s *StateMachine[C]) maxChainDepth() int {
+	if s.MaxChainDepth <= 0 {
+		return DefaultMaxChainDepth
+	}
+	return s.MaxChainDepth
+}
+
+// ChainCycles returns the loops that actions can chain through without any
+// event coming from outside, based on the events each state Emits. Each cycle
+// starts and ends in the same state and is reported once. Guards are not
+// evaluated, so a cycle may be broken at run time by a guard.
+func (s States[C]) ChainCycles() [][]ChainStep {
+
+	// edges holds, for each state, where the events its action emits lead.
+	edges := make(map[StateID][]ChainStep)
+	for _, id := range s.ids() {
+		for _, event := range s[id].Emits {
+			for _, target := range s.eventTargets(id, event) {
+				_, entries := s.route(id, target)
+				edges[id] = append(edges[id], ChainStep{Event: event, State: entries[len(entries)-1]})
+			}
+		}
+	}
+
+	var cycles [][]ChainStep
+	var walk func(start StateID, id StateID, chain []ChainStep, onChain map[StateID]bool)
+	walk = func(start StateID, id StateID, chain []ChainStep, onChain map[StateID]bool) {
+		for _, step := range edges[id] {
+			switch {
+			case step.State == start:
+				cycle := append(append([]ChainStep{}, chain...), step)
+				cycles = append(cycles, cycle)
+			case step.State > start && !onChain[step.State]:
+				// Only states after start are followed so that each cycle is
+				// found once, from its smallest state.
+				onChain[step.State] = true
+				walk(start, step.State, append(chain, step), onChain)
+				delete(onChain, step.State)
+			}
+		}
+	}
+	for _, id := range s.ids() {
+		walk(id, id, nil, map[StateID]bool{id: true})
+	}
+
+	return cycles
+}
+
+// eventTargets returns the states the event can lead to from the given state,
+// through the first of the state, its parents and Any that handles it.
+func (s States[C]) eventTargets(id StateID, event EventID) []StateID {
+	for _, p := range s.handlers(id) {
+		state := s[p]
+		var targets []StateID
+		for _, t := range state.Transitions[event] {
+			targets = append(targets, t.Target)
+		}
+		if next, ok := state.Events[event]; ok {
+			targets = append(targets, next)
+		}
+		if len(targets) > 0 {
+			return targets
+		}
+	}
+	return nil
+}
+
+// formatChain formats steps as "A -> S1, B -> S2".
+func formatChain(steps []ChainStep) string {
+	parts := make([]string, len(steps))
+	for i, step := range steps {
+		parts[i] = step.String()
+	}
+	return strings.Join(parts, ", ")
+}
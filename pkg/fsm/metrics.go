@@ -0,0 +1,209 @@
+package fsm
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultDwellBuckets are the upper bounds of the dwell time histogram buckets
+// used when CollectMetrics isn't given any.
+var DefaultDwellBuckets = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	time.Hour,
+}
+
+// StateMetrics represents what is known about the visits of a state. Visits
+// counts the visits that ended, Dwell is the time they lasted altogether and
+// Histogram counts them by duration, Histogram[i] being the visits that lasted
+// up to Buckets[i] and the last one those that lasted longer than every bucket.
+type StateMetrics struct {
+	Entries   int
+	Visits    int
+	Dwell     time.Duration
+	Histogram []int
+}
+
+// TransitionKey identifies a transition in the metrics.
+type TransitionKey struct {
+	From  StateID
+	Event EventID
+	To    StateID
+}
+
+// MetricsSnapshot represents the metrics collected since Since. A parent state
+// is visited for as long as the machine is in any of its children.
+type MetricsSnapshot struct {
+	Since       time.Time
+	Buckets     []time.Duration
+	States      map[StateID]StateMetrics
+	Transitions map[TransitionKey]int
+	Rejected    map[EventID]int
+}
+
+// Metrics collects the state entries and dwell times, the transitions and the
+// rejected events of a machine, see CollectMetrics. It is safe to read from
+// any goroutine, while the machine runs.
+type Metrics struct {
+	mutex    sync.Mutex
+	clock    Clock
+	snapshot MetricsSnapshot
+
+	// entered holds when the states the machine is in were entered.
+	entered map[StateID]time.Time
+}
+
+// CollectMetrics starts collecting metrics on the machine and returns them,
+// with dwell times counted in buckets, DefaultDwellBuckets if there are none.
+// The buckets must be in increasing order. The states the machine is in count
+// as entered now. It must not be called from an action or an observer.
+func (s *StateMachine[C]) CollectMetrics(buckets ...time.Duration) *Metrics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(buckets) == 0 {
+		buckets = DefaultDwellBuckets
+	}
+	m := &Metrics{clock: s.clock()}
+	m.snapshot.Buckets = append([]time.Duration(nil), buckets...)
+	m.restart(s.states().path(s.Current), m.clock.Now())
+	m.reset(m.clock.Now())
+
+	s.metrics = m
+	return m
+}
+
+// Snapshot returns a copy of the metrics collected so far. Visits still going
+// on are not counted in the dwell times yet.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.copy()
+}
+
+// Reset starts the metrics over and returns the ones collected until then, so
+// that none are lost between a Snapshot and a Reset. The visits going on when
+// it is called count in full once they end.
+func (m *Metrics) Reset() MetricsSnapshot {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	snapshot := m.copy()
+	m.reset(m.clock.Now())
+	return snapshot
+}
+
+// copy returns a deep copy of the snapshot. The caller must hold the mutex.
+func (m *Metrics) copy() MetricsSnapshot {
+	snapshot := MetricsSnapshot{
+		Since:       m.snapshot.Since,
+		Buckets:     append([]time.Duration(nil), m.snapshot.Buckets...),
+		States:      make(map[StateID]StateMetrics, len(m.snapshot.States)),
+		Transitions: make(map[TransitionKey]int, len(m.snapshot.Transitions)),
+		Rejected:    make(map[EventID]int, len(m.snapshot.Rejected)),
+	}
+	for id, state := range m.snapshot.States {
+		state.Histogram = append([]int(nil), state.Histogram...)
+		snapshot.States[id] = state
+	}
+	for key, count := range m.snapshot.Transitions {
+		snapshot.Transitions[key] = count
+	}
+	for event, count := range m.snapshot.Rejected {
+		snapshot.Rejected[event] = count
+	}
+	return snapshot
+}
+
+// reset empties the snapshot. The caller must hold the mutex.
+func (m *Metrics) reset(now time.Time) {
+	m.snapshot.Since = now
+	m.snapshot.States = make(map[StateID]StateMetrics)
+	m.snapshot.Transitions = make(map[TransitionKey]int)
+	m.snapshot.Rejected = make(map[EventID]int)
+}
+
+// restart forgets the visits going on, the states of path count as entered at
+// now without being counted as entries. It is used when the machine starts
+// collecting metrics or is restored.
+func (m *Metrics) restart(path []StateID, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.entered = make(map[StateID]time.Time, len(path))
+	for _, id := range path {
+		m.entered[id] = now
+	}
+}
+
+// enter counts an entry of the state.
+func (m *Metrics) enter(id StateID, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	state := m.snapshot.States[id]
+	state.Entries += 1
+	m.snapshot.States[id] = state
+	m.entered[id] = now
+}
+
+// exit counts the end of a visit of the state.
+func (m *Metrics) exit(id StateID, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entered, ok := m.entered[id]
+	if !ok {
+		return
+	}
+	delete(m.entered, id)
+	dwell := now.Sub(entered)
+
+	state := m.snapshot.States[id]
+	if state.Histogram == nil {
+		state.Histogram = make([]int, len(m.snapshot.Buckets)+1)
+	}
+	bucket := 0
+	for bucket < len(m.snapshot.Buckets) && dwell > m.snapshot.Buckets[bucket] {
+		bucket++
+	}
+	state.Histogram[bucket] += 1
+	state.Visits += 1
+	state.Dwell += dwell
+	m.snapshot.States[id] = state
+}
+
+// transition counts a transition.
+func (m *Metrics) transition(key TransitionKey) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.snapshot.Transitions[key] += 1
+}
+
+// reject counts a rejected event.
+func (m *Metrics) reject(event EventID) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.snapshot.Rejected[event] += 1
+}
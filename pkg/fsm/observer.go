@@ -0,0 +1,104 @@
+package fsm
+
+import (
+	"log"
+	"time"
+)
+
+// TransitionInfo describes a transition made by the state machine.
+type TransitionInfo struct {
+	From  StateID
+	To    StateID
+	Event EventID
+	Time  time.Time
+
+	// Payload is the payload of Event, nil for chained and timeout events.
+	Payload interface{}
+
+	// NextEvent is the event returned by the Action of To, NoOp if there is none.
+	NextEvent EventID
+}
+
+// Observer represents something that is told about every transition made by
+// the state machine. Observers run while the machine is locked so they must not
+// send events to it.
+type Observer interface {
+	OnTransition(info TransitionInfo)
+}
+
+// ObserverFunc is an adapter to allow the use of ordinary functions as observers.
+type ObserverFunc func(info TransitionInfo)
+
+// OnTransition calls f(info).
+func (f ObserverFunc) OnTransition(info TransitionInfo) {
+	f(info)
+}
+
+// NewLogObserver returns an observer that logs every transition, each line
+// starting with prefix.
+func NewLogObserver(prefix string) Observer {
+	return ObserverFunc(func(info TransitionInfo) {
+		log.Printf("%v: %v -> %v on %v, next %v\n", prefix, info.From, info.To, info.Event, info.NextEvent)
+	})
+}
+
+// Handler represents the handling of an event sent to the state machine.
+type Handler[C any] func(event Event, eventCtx C) error
+
+// Interceptor wraps a Handler, it can act before and after calling next or
+// decide not to call it at all. Interceptors run while the machine is locked so
+// they must not send events to it.
+type Interceptor[C any] func(next Handler[C]) Handler[C]
+
+// Origin tells where an event handled by the state machine comes from.
+type Origin int
+
+const (
+	// OriginSent is the origin of the events sent with SendEvent or Send.
+	OriginSent Origin = iota
+	// OriginTimeout is the origin of the events sent by state timeouts.
+	OriginTimeout
+	// OriginScheduled is the origin of the events scheduled with SendAfter.
+	OriginScheduled
+)
+
+// EventOrigin returns where the event being handled comes from. Interceptors
+// see the timeout and scheduled events along with the ones sent to the machine,
+// EventOrigin tells them apart. It must only be called from an interceptor.
+func (s *StateMachine[C]) EventOrigin() Origin {
+	return s.origin
+}
+
+// AddObserver registers an observer with the state machine.
+func (s *StateMachine[C]) AddObserver(observer Observer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.observers = append(s.observers, observer)
+}
+
+// Use adds interceptors around the handling of events. The first interceptor
+// registered is the outermost.
+func (s *StateMachine[C]) Use(interceptors ...Interceptor[C]) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// handler returns sendEvent wrapped in the registered interceptors. The caller
+// must hold the mutex.
+func (s *StateMachine[C]) handler() Handler[C] {
+	h := Handler[C](s.sendEvent)
+	for i := len(s.interceptors) - 1; i >= 0; i-- {
+		h = s.interceptors[i](h)
+	}
+	return h
+}
+
+// notify tells the observers about a transition. The caller must hold the mutex.
+func (s *StateMachine[C]) notify(info TransitionInfo) {
+	for _, observer := range s.observers {
+		observer.OnTransition(info)
+	}
+}
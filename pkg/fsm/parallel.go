@@ -0,0 +1,179 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Region represents one of the independent concerns of a Parallel machine, a
+// machine of its own that works on part of the Parallel machine's context. The
+// context type of the machine is hidden, regions are made with NewRegion.
+type Region[C any] interface {
+	name() string
+	handles(event EventID) bool
+	send(event Event, eventCtx C) error
+	current() StateID
+	availableEvents() []EventID
+}
+
+// projection is the region of a machine with context type R in a Parallel
+// machine with context type C.
+type projection[C, R any] struct {
+	regionName string
+	machine    *StateMachine[R]
+	project    func(eventCtx C) R
+
+	// alphabet holds every event the machine's states handle.
+	alphabet map[EventID]bool
+}
+
+// NewRegion returns a region named name that runs machine, with the context
+// project returns from the Parallel machine's context. The region is only sent
+// the events its states handle somewhere, the others are for other regions.
+func NewRegion[C, R any](name string, machine *StateMachine[R], project func(eventCtx C) R) Region[C] {
+	alphabet := make(map[EventID]bool)
+	for _, state := range machine.states() {
+		for event := range state.Events {
+			alphabet[event] = true
+		}
+		for event := range state.Transitions {
+			alphabet[event] = true
+		}
+	}
+
+	return &projection[C, R]{
+		regionName: name,
+		machine:    machine,
+		project:    project,
+		alphabet:   alphabet,
+	}
+}
+
+func (p *projection[C, R]) name() string {
+	return p.regionName
+}
+
+func (p *projection[C, R]) handles(event EventID) bool {
+	return p.alphabet[event]
+}
+
+func (p *projection[C, R]) send(event Event, eventCtx C) error {
+	return p.machine.Send(event, p.project(eventCtx))
+}
+
+func (p *projection[C, R]) current() StateID {
+	return p.machine.CurrentState()
+}
+
+func (p *projection[C, R]) availableEvents() []EventID {
+	return p.machine.AvailableEvents()
+}
+
+// RegionState represents the current state of a region.
+type RegionState struct {
+	Region string
+	State  StateID
+}
+
+// Configuration represents the current state of each region of a Parallel
+// machine, in region order.
+type Configuration []RegionState
+
+func (c Configuration) String() string {
+	parts := make([]string, len(c))
+	for i, r := range c {
+		parts[i] = fmt.Sprintf("%v=%v", r.Region, r.State)
+	}
+	return strings.Join(parts, " ")
+}
+
+// State returns the current state of the named region, or "" if there is no
+// such region.
+func (c Configuration) State(region string) StateID {
+	for _, r := range c {
+		if r.Region == region {
+			return r.State
+		}
+	}
+	return ""
+}
+
+// Parallel represents a machine made of orthogonal regions, each of them in a
+// state of its own at all times. Events are broadcast to the regions.
+type Parallel[C any] struct {
+	regions []Region[C]
+
+	// mutex ensures that only 1 event is broadcast at any given time, so that
+	// every region sees the events in the same order.
+	mutex sync.Mutex
+}
+
+// NewParallel returns a machine made of the regions, which must have distinct
+// names.
+func NewParallel[C any](regions ...Region[C]) *Parallel[C] {
+	return &Parallel[C]{regions: regions}
+}
+
+// SendEvent sends an event without a payload to the regions, see Send.
+func (p *Parallel[C]) SendEvent(event EventID, eventCtx C) error {
+	return p.Send(Event{ID: event}, eventCtx)
+}
+
+// Send sends an event to every region that handles it, in region order, each
+// region running its transitions to completion before the next one is sent the
+// event. It returns ErrEventRejected if no region handles the event at all, and
+// otherwise the errors of the regions, joined, each one prefixed by the region
+// name. Timeouts and scheduled events of a region are sent to that region only.
+func (p *Parallel[C]) Send(event Event, eventCtx C) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var errs []error
+	handled := false
+	for _, r := range p.regions {
+		if !r.handles(event.ID) {
+			continue
+		}
+		handled = true
+		if err := r.send(event, eventCtx); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", r.name(), err))
+		}
+	}
+
+	if !handled {
+		return fmt.Errorf("%w: no region handles %q", ErrEventRejected, event.ID)
+	}
+	return errors.Join(errs...)
+}
+
+// Configuration returns the current state of each region. It is safe to call
+// at any time, from an action or an observer too.
+func (p *Parallel[C]) Configuration() Configuration {
+	config := make(Configuration, len(p.regions))
+	for i, r := range p.regions {
+		config[i] = RegionState{Region: r.name(), State: r.current()}
+	}
+	return config
+}
+
+// AvailableEvents returns the events the current state of any region handles,
+// in a stable order. It is safe to call at any time, from an action or an
+// observer too.
+func (p *Parallel[C]) AvailableEvents() []EventID {
+	seen := make(map[EventID]bool)
+	var events []EventID
+	for _, r := range p.regions {
+		for _, event := range r.availableEvents() {
+			if !seen[event] {
+				seen[event] = true
+				events = append(events, event)
+			}
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	return events
+}
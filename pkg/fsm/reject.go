@@ -0,0 +1,46 @@
+package fsm
+
+// RejectPolicy tells a StateMachine what to do with an event that the current
+// state, its parents and Any don't handle.
+type RejectPolicy int
+
+const (
+	// ReturnRejected returns ErrEventRejected, or ErrGuardRejected, and leaves
+	// the machine where it is.
+	ReturnRejected RejectPolicy = iota
+
+	// IgnoreRejected drops the event and leaves the machine where it is.
+	IgnoreRejected
+
+	// EnterErrorState moves the machine to its ErrorState as if the event led
+	// there. Events rejected while the machine is in the error state, or in one
+	// of its children, are returned as with ReturnRejected.
+	EnterErrorState
+)
+
+// RejectRecorder is implemented by contexts that want to know which event was
+// rejected, and in which state, before the machine enters its error state.
+type RejectRecorder interface {
+	RecordRejected(event EventID, from StateID)
+}
+
+// reject applies the machine's RejectPolicy to an event that getNextState
+// rejected with err. It returns the transition to take, if ok, otherwise the
+// error to return, nil when the event is ignored.
+func (s *StateMachine[C]) reject(event EventID, eventCtx C, err error) (transition Transition[C], ok bool, _ error) {
+	switch s.Reject {
+	case IgnoreRejected:
+		return Transition[C]{}, false, nil
+
+	case EnterErrorState:
+		if s.Current == s.ErrorState || s.states().isAncestor(s.ErrorState, s.Current) {
+			return Transition[C]{}, false, err
+		}
+		if recorder, ok := any(eventCtx).(RejectRecorder); ok {
+			recorder.RecordRejected(event, s.Current)
+		}
+		return Transition[C]{Target: s.ErrorState}, true, nil
+	}
+
+	return Transition[C]{}, false, err
+}
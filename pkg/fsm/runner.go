@@ -0,0 +1,206 @@
+package fsm
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultInboxSize is the inbox size used when a RunnerConfig doesn't set one.
+const DefaultInboxSize = 16
+
+// OverflowPolicy tells a Runner what to do with an event posted to a full inbox.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the event being posted.
+	DropNewest OverflowPolicy = iota
+
+	// DropOldest drops the oldest event in the inbox to make room.
+	DropOldest
+
+	// Block waits for room in the inbox, the event is dropped if the runner is
+	// stopped meanwhile or is not running. It must not be used from an
+	// interrupt handler.
+	Block
+)
+
+// RunnerConfig represents the configuration of a Runner.
+type RunnerConfig struct {
+	// Size is the capacity of the inbox, DefaultInboxSize is used when it is 0.
+	Size int
+
+	// Overflow is what to do when the inbox is full.
+	Overflow OverflowPolicy
+
+	// OnError, if set, is called with the events the machine returns an error for.
+	OnError func(event EventID, err error)
+}
+
+// RunnerStats represents the event counts of a Runner.
+type RunnerStats struct {
+	Posted        uint64
+	Dispatched    uint64
+	DroppedOldest uint64
+	DroppedNewest uint64
+}
+
+// Runner feeds a state machine from a bounded inbox on a goroutine of its own.
+// Posting an event never takes the machine's mutex, so interrupt handlers can
+// post, and events are sent to the machine one at a time, each one running to
+// completion before the next is taken from the inbox.
+type Runner[C any] struct {
+	machine  *StateMachine[C]
+	eventCtx C
+	config   RunnerConfig
+	inbox    chan Event
+
+	posted        atomic.Uint64
+	dispatched    atomic.Uint64
+	droppedOldest atomic.Uint64
+	droppedNewest atomic.Uint64
+
+	// mutex guards starting and stopping the dispatch goroutine.
+	mutex sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewRunner returns a stopped Runner that sends events to machine with eventCtx.
+func NewRunner[C any](machine *StateMachine[C], eventCtx C, config RunnerConfig) *Runner[C] {
+	if config.Size <= 0 {
+		config.Size = DefaultInboxSize
+	}
+
+	return &Runner[C]{
+		machine:  machine,
+		eventCtx: eventCtx,
+		config:   config,
+		inbox:    make(chan Event, config.Size),
+	}
+}
+
+// Start launches the dispatch goroutine, it does nothing if it is running.
+func (r *Runner[C]) Start() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go r.dispatch(r.stop, r.done)
+}
+
+// Stop waits for the event being sent to the machine, if any, and stops the
+// dispatch goroutine. Events still in the inbox stay there until the next Start,
+// posts blocked on the full inbox return false.
+func (r *Runner[C]) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+	r.done = nil
+}
+
+// Post puts an event without a payload in the inbox, see PostEvent.
+func (r *Runner[C]) Post(event EventID) bool {
+	return r.PostEvent(Event{ID: event})
+}
+
+// PostEvent puts an event in the inbox. It returns false if the event was
+// dropped because the inbox was full and the overflow policy is DropNewest, or
+// Block and the runner stopped.
+func (r *Runner[C]) PostEvent(event Event) bool {
+	r.posted.Add(1)
+
+	switch r.config.Overflow {
+	case Block:
+		select {
+		case r.inbox <- event:
+			return true
+		default:
+		}
+
+		r.mutex.Lock()
+		stop := r.stop
+		r.mutex.Unlock()
+		if stop == nil {
+			r.droppedNewest.Add(1)
+			return false
+		}
+
+		select {
+		case r.inbox <- event:
+			return true
+		case <-stop:
+			r.droppedNewest.Add(1)
+			return false
+		}
+
+	case DropOldest:
+		for {
+			select {
+			case r.inbox <- event:
+				return true
+			default:
+			}
+
+			select {
+			case <-r.inbox:
+				r.droppedOldest.Add(1)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case r.inbox <- event:
+			return true
+		default:
+			r.droppedNewest.Add(1)
+			return false
+		}
+	}
+}
+
+// Stats returns the runner's event counts.
+func (r *Runner[C]) Stats() RunnerStats {
+	return RunnerStats{
+		Posted:        r.posted.Load(),
+		Dispatched:    r.dispatched.Load(),
+		DroppedOldest: r.droppedOldest.Load(),
+		DroppedNewest: r.droppedNewest.Load(),
+	}
+}
+
+// dispatch sends the events in the inbox to the machine until stop is closed.
+func (r *Runner[C]) dispatch(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	for {
+		// Check stop first so that a busy inbox can't keep the runner going.
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		select {
+		case <-stop:
+			return
+		case event := <-r.inbox:
+			err := r.machine.Send(event, r.eventCtx)
+			r.dispatched.Add(1)
+			if err != nil && r.config.OnError != nil {
+				r.config.OnError(event.ID, err)
+			}
+		}
+	}
+}
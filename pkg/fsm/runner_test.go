@@ -0,0 +1,162 @@
+package fsm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newRunnerMachine returns a machine that toggles between Default and "On",
+// telling seen about every event it moves on.
+func newRunnerMachine(seen chan EventID) *AnyStateMachine {
+	sm := &AnyStateMachine{
+		Current: Default,
+		States: AnyStates{
+			Default: AnyState{Action: &countAction{}, Events: Events{"A": "On", "B": "On", "C": "On"}},
+			"On":    AnyState{Action: &countAction{}, Events: Events{"A": Default, "B": Default, "C": Default}},
+		},
+	}
+	sm.AddObserver(ObserverFunc(func(info TransitionInfo) {
+		seen <- info.Event
+	}))
+	return sm
+}
+
+// receive returns the next n events from seen, failing the test if they are
+// slow to come.
+func receive(t *testing.T, seen chan EventID, n int) []EventID {
+	t.Helper()
+
+	var events []EventID
+	for i := 0; i < n; i++ {
+		select {
+		case event := <-seen:
+			events = append(events, event)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for events, got %v", events)
+		}
+	}
+	return events
+}
+
+func TestRunner(t *testing.T) {
+
+	//
+	// DropNewest keeps what is already in the inbox
+	//
+	seen := make(chan EventID, 10)
+	r := NewRunner[EventContext](newRunnerMachine(seen), nil, RunnerConfig{Size: 2})
+	if !r.Post("A") || !r.Post("B") || r.Post("C") {
+		t.Errorf("DropNewest post\nexpected: true true false")
+	}
+	r.Start()
+	if events := receive(t, seen, 2); events[0] != "A" || events[1] != "B" {
+		t.Errorf("DropNewest\nexpected: [A B]\ngot:      %v", events)
+	}
+	r.Stop()
+
+	stats := r.Stats()
+	if stats != (RunnerStats{Posted: 3, Dispatched: 2, DroppedNewest: 1}) {
+		t.Errorf("DropNewest stats\nexpected: {Posted:3 Dispatched:2 DroppedNewest:1}\ngot:      %+v", stats)
+	}
+
+	//
+	// DropOldest makes room for the event being posted
+	//
+	seen = make(chan EventID, 10)
+	r = NewRunner[EventContext](newRunnerMachine(seen), nil, RunnerConfig{Size: 2, Overflow: DropOldest})
+	r.Post("A")
+	r.Post("B")
+	r.Post("C")
+	r.Start()
+	if events := receive(t, seen, 2); events[0] != "B" || events[1] != "C" {
+		t.Errorf("DropOldest\nexpected: [B C]\ngot:      %v", events)
+	}
+	r.Stop()
+
+	if stats := r.Stats(); stats.DroppedOldest != 1 {
+		t.Errorf("DropOldest stats\nexpected: DroppedOldest:1\ngot:      %+v", stats)
+	}
+
+	//
+	// Events posted while stopped wait for the next start, errors are reported
+	//
+	seen = make(chan EventID, 10)
+	var failed []EventID
+	r = NewRunner[EventContext](newRunnerMachine(seen), nil, RunnerConfig{
+		OnError: func(event EventID, err error) {
+			if errors.Is(err, ErrEventRejected) {
+				failed = append(failed, event)
+			}
+		},
+	})
+	r.Start()
+	r.Stop()
+	r.Post("Unknown")
+	r.Post("A")
+	r.Start()
+	receive(t, seen, 1)
+	r.Stop()
+
+	if len(failed) != 1 || failed[0] != "Unknown" {
+		t.Errorf("OnError\nexpected: [Unknown]\ngot:      %v", failed)
+	}
+
+	//
+	// Block waits for dispatch to make room, Stop releases a blocked post
+	//
+	// seen isn't buffered, the machine holds each event until it is received
+	seen = make(chan EventID)
+	r = NewRunner[EventContext](newRunnerMachine(seen), nil, RunnerConfig{Size: 1, Overflow: Block})
+	r.Start()
+	post := func(event EventID) chan bool {
+		posted := make(chan bool, 1)
+		go func() { posted <- r.Post(event) }()
+		return posted
+	}
+	blocked := func(name string, posted chan bool) {
+		select {
+		case ok := <-posted:
+			t.Fatalf("%v\nexpected: blocked\ngot:      %v", name, ok)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// A is held by the machine once B is in the inbox
+	r.Post("A")
+	r.Post("B")
+	posted := post("C")
+	blocked("full inbox", posted)
+	if events := receive(t, seen, 1); events[0] != "A" {
+		t.Errorf("Block\nexpected: [A]\ngot:      %v", events)
+	}
+	if ok := <-posted; !ok {
+		t.Errorf("room made\nexpected: true\ngot:      %v", ok)
+	}
+	if events := receive(t, seen, 2); events[0] != "B" || events[1] != "C" {
+		t.Errorf("Block\nexpected: [B C]\ngot:      %v", events)
+	}
+
+	r.Post("A")
+	r.Post("B")
+	posted = post("C")
+	blocked("before stop", posted)
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+	if ok := <-posted; ok {
+		t.Errorf("stop\nexpected: false\ngot:      %v", ok)
+	}
+	receive(t, seen, 1)
+	<-stopped
+
+	// A stopped runner makes no room
+	if r.Post("A") {
+		t.Errorf("stopped\nexpected: false\ngot:      true")
+	}
+	if stats := r.Stats(); stats.Dispatched != 4 || stats.DroppedNewest != 2 {
+		t.Errorf("Block stats\nexpected: Dispatched:4 DroppedNewest:2\ngot:      %+v", stats)
+	}
+}
@@ -0,0 +1,126 @@
+package fsm
+
+import "time"
+
+// scheduledEvent is an event sent to the machine once a delay is over, unless
+// the state that scheduled it is left first.
+type scheduledEvent[C any] struct {
+	machine *StateMachine[C]
+	state   StateID
+	event   Event
+	timer   Timer
+}
+
+// Stop cancels the event. It returns false if the event was already sent or
+// cancelled.
+func (e *scheduledEvent[C]) Stop() bool {
+	s := e.machine
+	s.scheduleMutex.Lock()
+	defer s.scheduleMutex.Unlock()
+
+	if !s.unschedule(e) {
+		return false
+	}
+	e.timer.Stop()
+	return true
+}
+
+// SendEventAfter sends an event without a payload to the machine once d has
+// passed on the machine's clock, see SendAfter.
+func (s *StateMachine[C]) SendEventAfter(d time.Duration, event EventID) Timer {
+	return s.SendAfter(d, Event{ID: event})
+}
+
+// SendAfter sends an event to the machine once d has passed on the machine's
+// clock, with the context of the last event. The event is cancelled if the
+// machine leaves the state it belongs to first, or when the returned Timer is
+// stopped. It belongs to the current state, unless SendAfter is called from an
+// action, then it belongs to the state of the action: a parent's OnEnter
+// schedules events that last as long as the machine stays in the parent.
+// Events scheduled by OnExit or transition actions belong to the state being
+// left, so they are cancelled right away. Errors from the event are dropped, as
+// they are for timeouts.
+func (s *StateMachine[C]) SendAfter(d time.Duration, event Event) Timer {
+	s.scheduleMutex.Lock()
+	defer s.scheduleMutex.Unlock()
+
+	state := s.running
+	if state == "" {
+		state = s.CurrentState()
+	}
+	e := &scheduledEvent[C]{machine: s, state: state, event: event}
+	if s.scheduled == nil {
+		s.scheduled = make(map[StateID][]*scheduledEvent[C])
+	}
+	s.scheduled[e.state] = append(s.scheduled[e.state], e)
+	e.timer = s.clock().AfterFunc(d, func() { s.fireScheduled(e) })
+
+	return e
+}
+
+// runningIn records the state whose action is running, "" once it returns.
+func (s *StateMachine[C]) runningIn(id StateID) {
+	s.scheduleMutex.Lock()
+	defer s.scheduleMutex.Unlock()
+
+	s.running = id
+}
+
+// fireScheduled sends a scheduled event, unless it was cancelled since.
+func (s *StateMachine[C]) fireScheduled(e *scheduledEvent[C]) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.scheduleMutex.Lock()
+	pending := s.unschedule(e)
+	s.scheduleMutex.Unlock()
+	if !pending {
+		return
+	}
+
+	s.origin = OriginScheduled
+	defer func() { s.origin = OriginSent }()
+	s.handler()(e.event, s.eventCtx)
+}
+
+// cancelScheduled cancels the events scheduled in a state being exited. The
+// caller must hold the mutex.
+func (s *StateMachine[C]) cancelScheduled(id StateID) {
+	s.scheduleMutex.Lock()
+	defer s.scheduleMutex.Unlock()
+
+	for _, e := range s.scheduled[id] {
+		e.timer.Stop()
+	}
+	delete(s.scheduled, id)
+}
+
+// cancelAllScheduled cancels every scheduled event. The caller must hold the
+// mutex.
+func (s *StateMachine[C]) cancelAllScheduled() {
+	s.scheduleMutex.Lock()
+	defer s.scheduleMutex.Unlock()
+
+	for _, events := range s.scheduled {
+		for _, e := range events {
+			e.timer.Stop()
+		}
+	}
+	s.scheduled = nil
+}
+
+// unschedule forgets a scheduled event, it reports whether it was pending. The
+// caller must hold scheduleMutex.
+func (s *StateMachine[C]) unschedule(e *scheduledEvent[C]) bool {
+	pending := s.scheduled[e.state]
+	for i, p := range pending {
+		if p == e {
+			s.scheduled[e.state] = append(pending[:i:i], pending[i+1:]...)
+			if len(s.scheduled[e.state]) == 0 {
+				delete(s.scheduled, e.state)
+			}
+			return true
+		}
+	}
+	return false
+}
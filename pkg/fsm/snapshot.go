@@ -0,0 +1,118 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// ErrSnapshot is matched by the errors returned when a snapshot can't be
+// restored.
+var ErrSnapshot = errors.New("invalid snapshot")
+
+// Snapshot represents a state machine and its context at a point in time. It
+// can be serialized, to JSON for example, and restored after a reboot.
+type Snapshot[C any] struct {
+	// Version is the version of the definition the snapshot was taken with.
+	Version  string  `json:"version"`
+	Current  StateID `json:"current"`
+	Previous StateID `json:"previous"`
+	Context  C       `json:"context"`
+}
+
+// Version returns a fingerprint of the definition. It changes when states,
+// events, parents or timeouts change, but not when the code of an action does.
+func (s States[C]) Version() string {
+	var b strings.Builder
+
+	ids := s.ids()
+	if _, ok := s[Any]; ok {
+		ids = append(ids, Any)
+	}
+	for _, id := range ids {
+		state := s[id]
+		fmt.Fprintf(&b, "%q parent=%q initial=%q timeout=%v/%q action=%v emits=%q\n",
+			id, state.Parent, state.Initial, state.Timeout, state.TimeoutEvent, state.Action != nil, state.Emits)
+		if len(state.Defer) > 0 {
+			fmt.Fprintf(&b, "  defer=%q\n", state.Defer)
+		}
+
+		for _, event := range sortedEvents(state.Transitions) {
+			for _, t := range state.Transitions[event] {
+				fmt.Fprintf(&b, "  %q -> %q guarded=%v\n", event, t.Target, t.Guard != nil)
+			}
+		}
+		for _, event := range sortedEvents(state.Events) {
+			fmt.Fprintf(&b, "  %q -> %q\n", event, state.Events[event])
+		}
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(b.String()))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Snapshot returns the machine's current and previous state along with ctx.
+func (s *StateMachine[C]) Snapshot(eventCtx C) Snapshot[C] {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return Snapshot[C]{
+		Version:  s.states().Version(),
+		Current:  s.Current,
+		Previous: s.Previous,
+		Context:  eventCtx,
+	}
+}
+
+// Restore puts the machine back in the state recorded by a snapshot. The
+// snapshot must come from the same definition and name states the machine can
+// rest in. No actions run, but the timeouts of the restored states start over
+// and events scheduled with SendAfter, or deferred, are dropped.
+// Timeouts are sent with the snapshot's context, metrics count the restored
+// states as entered at the time of the restore.
+func (s *StateMachine[C]) Restore(snap Snapshot[C]) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if version := s.states().Version(); snap.Version != version {
+		return fmt.Errorf("%w: definition version %v, expected %v", ErrSnapshot, snap.Version, version)
+	}
+	if !s.states().isLeaf(snap.Current) {
+		return fmt.Errorf("%w: machine can't rest in state %q", ErrSnapshot, snap.Current)
+	}
+	if _, ok := s.states()[snap.Previous]; (!ok || snap.Previous == Any) && snap.Previous != "" {
+		return fmt.Errorf("%w: previous state %q is missing", ErrSnapshot, snap.Previous)
+	}
+
+	s.stopAll()
+	s.deferred = nil
+
+	s.stateMutex.Lock()
+	s.Current = snap.Current
+	s.Previous = snap.Previous
+	s.stateMutex.Unlock()
+	s.eventCtx = snap.Context
+
+	path := s.states().path(s.Current)
+	s.metrics.restart(path, s.clock().Now())
+	for i := len(path) - 1; i >= 0; i-- {
+		s.startTimeout(path[i])
+	}
+
+	return nil
+}
+
+// isLeaf reports whether the state exists and has no children.
+func (s States[C]) isLeaf(id StateID) bool {
+	if _, ok := s[id]; !ok || id == Any {
+		return false
+	}
+	for _, state := range s {
+		if state.Parent == id {
+			return false
+		}
+	}
+	return true
+}
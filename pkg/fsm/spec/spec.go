@@ -0,0 +1,503 @@
+// Package spec loads fsm definitions from YAML or JSON documents.
+//
+// A document names its states, the events they handle and the actions and
+// guards they run. The names of actions and guards are bound to their Go
+// implementations through fsm.Bindings:
+//
+//	name: marty
+//	states:
+//	  DEFAULT:
+//	    action: DefaultAction
+//	    events:
+//	      FarRising: Arriving
+//	  Arriving:
+//	    parent: VehiclePresent
+//	    action: ArrivingAction
+//	    transitions:
+//	      NearRising:
+//	        - target: Arrived
+//	          guard: ShortGap
+//	  VehiclePresent:
+//	    timeout: 30s
+//	    timeoutEvent: Timeout
+//	    events:
+//	      Timeout: FalseAlarm
+//
+// JSON documents have the same shape. Errors about the document point at the
+// line they come from, the states it defines are then checked with Validate and
+// the problems it finds point at their lines too.
+package spec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrSpec is matched by every error about the content of a document.
+var ErrSpec = errors.New("spec")
+
+// Error represents a problem at a line of a document.
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: line %d: %v", ErrSpec, e.Line, e.Msg)
+}
+
+// Is reports whether target is ErrSpec.
+func (e *Error) Is(target error) bool {
+	return target == ErrSpec
+}
+
+// ValidationError represents the problems Validate found in the states of a
+// document, each at the line it comes from. It matches ErrSpec and
+// fsm.ErrEventConfig with errors.Is, and errors.As finds its first Error.
+type ValidationError struct {
+	Errors []*Error
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		problems[i] = fmt.Sprintf("line %d: %v", err.Line, err.Msg)
+	}
+	return fmt.Sprintf("%v: %v: %v", ErrSpec, fsm.ErrEventConfig, strings.Join(problems, "; "))
+}
+
+// Is reports whether target is ErrSpec or fsm.ErrEventConfig.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrSpec || target == fsm.ErrEventConfig
+}
+
+// Unwrap returns the Errors.
+func (e *ValidationError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// errorf returns an *Error for the line of node.
+func errorf(node *yaml.Node, format string, args ...interface{}) error {
+	return &Error{Line: node.Line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Name represents a name in a document along with the line it is on.
+type Name struct {
+	Value string
+	Line  int
+}
+
+// UnmarshalYAML reads a name from a scalar node.
+func (n *Name) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return errorf(node, "expected a name")
+	}
+	n.Value = node.Value
+	n.Line = node.Line
+	return nil
+}
+
+// Edge represents an event and the state it leads to.
+type Edge struct {
+	Event  Name
+	Target Name
+}
+
+// Transition represents a guarded transition.
+type Transition struct {
+	Target Name
+	Guard  Name
+	Action Name
+	Line   int
+}
+
+// UnmarshalYAML reads a transition from a mapping node.
+func (t *Transition) UnmarshalYAML(node *yaml.Node) error {
+	t.Line = node.Line
+	return decodeMapping(node, map[string]interface{}{
+		"target": &t.Target,
+		"guard":  &t.Guard,
+		"action": &t.Action,
+	})
+}
+
+// Guarded represents an event and its candidate transitions, in order.
+type Guarded struct {
+	Event       Name
+	Transitions []Transition
+}
+
+// State represents the definition of a state.
+type State struct {
+	ID   Name
+	Line int
+
+	Action  Name
+	OnEnter Name
+	OnExit  Name
+	Parent  Name
+	Initial Name
+
+	Timeout      Name
+	TimeoutEvent Name
+	Emits        []Name
+	Defer        []Name
+
+	Events      []Edge
+	Transitions []Guarded
+}
+
+// UnmarshalYAML reads a state from a mapping node.
+func (s *State) UnmarshalYAML(node *yaml.Node) error {
+	s.Line = node.Line
+
+	var events, transitions yaml.Node
+	err := decodeMapping(node, map[string]interface{}{
+		"action":       &s.Action,
+		"onEnter":      &s.OnEnter,
+		"onExit":       &s.OnExit,
+		"parent":       &s.Parent,
+		"initial":      &s.Initial,
+		"timeout":      &s.Timeout,
+		"timeoutEvent": &s.TimeoutEvent,
+		"emits":        &s.Emits,
+		"defer":        &s.Defer,
+		"events":       &events,
+		"transitions":  &transitions,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = eachPair(&events, func(key *yaml.Node, value *yaml.Node) error {
+		edge := Edge{Event: Name{Value: key.Value, Line: key.Line}}
+		if err := value.Decode(&edge.Target); err != nil {
+			return err
+		}
+		s.Events = append(s.Events, edge)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return eachPair(&transitions, func(key *yaml.Node, value *yaml.Node) error {
+		guarded := Guarded{Event: Name{Value: key.Value, Line: key.Line}}
+		if value.Kind != yaml.SequenceNode {
+			return errorf(value, "expected a list of transitions for %q", key.Value)
+		}
+		if err := value.Decode(&guarded.Transitions); err != nil {
+			return err
+		}
+		s.Transitions = append(s.Transitions, guarded)
+		return nil
+	})
+}
+
+// Machine represents a state machine definition, its states in document order.
+// Line is the line the definition starts at.
+type Machine struct {
+	Name    string
+	Version string
+	States  []*State
+	Line    int
+}
+
+// UnmarshalYAML reads a machine from a mapping node.
+func (m *Machine) UnmarshalYAML(node *yaml.Node) error {
+	m.Line = node.Line
+
+	var states yaml.Node
+	err := decodeMapping(node, map[string]interface{}{
+		"name":    &m.Name,
+		"version": &m.Version,
+		"states":  &states,
+	})
+	if err != nil {
+		return err
+	}
+
+	return eachPair(&states, func(key *yaml.Node, value *yaml.Node) error {
+		state := &State{}
+		if err := value.Decode(state); err != nil {
+			return err
+		}
+		state.ID = Name{Value: key.Value, Line: key.Line}
+		m.States = append(m.States, state)
+		return nil
+	})
+}
+
+// decodeMapping decodes the values of a mapping node into the fields named by
+// their keys, rejecting keys it doesn't know.
+func decodeMapping(node *yaml.Node, fields map[string]interface{}) error {
+	return eachPair(node, func(key *yaml.Node, value *yaml.Node) error {
+		field, ok := fields[key.Value]
+		if !ok {
+			return errorf(key, "unknown field %q", key.Value)
+		}
+		if raw, ok := field.(*yaml.Node); ok {
+			*raw = *value
+			return nil
+		}
+		return value.Decode(field)
+	})
+}
+
+// eachPair calls f for each key and value of a mapping node, in order. A zero
+// node, a field that was left out, has no pairs.
+func eachPair(node *yaml.Node, f func(key *yaml.Node, value *yaml.Node) error) error {
+	if node.Kind == 0 {
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return errorf(node, "expected a mapping")
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if seen[key.Value] {
+			return errorf(key, "duplicate key %q", key.Value)
+		}
+		seen[key.Value] = true
+		if err := f(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse reads a machine definition from a YAML or JSON document.
+func Parse(data []byte) (*Machine, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSpec, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%w: empty document", ErrSpec)
+	}
+
+	m := &Machine{}
+	if err := doc.Content[0].Decode(m); err != nil {
+		var specErr *Error
+		if errors.As(err, &specErr) {
+			return nil, specErr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrSpec, err)
+	}
+	return m, nil
+}
+
+// Load reads a machine definition from r, binds it and validates it.
+func Load[C any](r io.Reader, bindings fsm.Bindings[C]) (fsm.States[C], error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	m, err := Parse(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	states, err := Build(m, bindings)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := states.Validate(); err != nil {
+		return nil, Locate(m, err)
+	}
+	return states, nil
+}
+
+// Locate turns the *fsm.ValidationError returned when validating the states
+// built from m into a *ValidationError, pointing each problem at the line of
+// the document it comes from. Other errors are returned as they are.
+func Locate(m *Machine, err error) error {
+	var invalid *fsm.ValidationError
+	if !errors.As(err, &invalid) {
+		return err
+	}
+
+	located := &ValidationError{}
+	for i, problem := range invalid.Problems {
+		line := m.Line
+		if i < len(invalid.Locations) {
+			line = m.line(invalid.Locations[i])
+		}
+		located.Errors = append(located.Errors, &Error{Line: line, Msg: problem})
+	}
+	return located
+}
+
+// line returns the line of the document a problem found by Validate is at: the
+// line of the field or event it is about, or of its state, or the line the
+// definition starts at when it is about no state in particular.
+func (m *Machine) line(at fsm.Location) int {
+	var def *State
+	for _, state := range m.States {
+		if fsm.StateID(state.ID.Value) == at.State {
+			def = state
+		}
+	}
+	if def == nil {
+		return m.Line
+	}
+
+	var line int
+	switch at.Field {
+	case "Events":
+		for _, edge := range def.Events {
+			if fsm.EventID(edge.Event.Value) == at.Event && fsm.StateID(edge.Target.Value) == at.Target {
+				line = edge.Target.Line
+			}
+		}
+	case "Transitions":
+		for _, guarded := range def.Transitions {
+			if fsm.EventID(guarded.Event.Value) != at.Event {
+				continue
+			}
+			for _, t := range guarded.Transitions {
+				if fsm.StateID(t.Target.Value) == at.Target && line == 0 {
+					line = t.Target.Line
+				}
+			}
+		}
+	case "Parent":
+		line = def.Parent.Line
+	case "Initial":
+		line = def.Initial.Line
+	case "Timeout":
+		line = def.Timeout.Line
+	case "TimeoutEvent":
+		line = def.TimeoutEvent.Line
+	case "Emits":
+		line = nameLine(def.Emits, at.Event)
+	case "Defer":
+		line = nameLine(def.Defer, at.Event)
+	}
+
+	if line == 0 {
+		return def.ID.Line
+	}
+	return line
+}
+
+// nameLine returns the line of the event in names, 0 if it isn't there.
+func nameLine(names []Name, event fsm.EventID) int {
+	for _, name := range names {
+		if fsm.EventID(name.Value) == event {
+			return name.Line
+		}
+	}
+	return 0
+}
+
+// Build turns a machine definition into fsm states, looking up the actions and
+// guards it names in bindings. The states are not validated.
+func Build[C any](m *Machine, bindings fsm.Bindings[C]) (fsm.States[C], error) {
+	states := make(fsm.States[C], len(m.States))
+
+	action := func(name Name) (fsm.Action[C], error) {
+		if name.Value == "" {
+			return nil, nil
+		}
+		a, ok := bindings.Actions[name.Value]
+		if !ok {
+			return nil, &Error{Line: name.Line, Msg: fmt.Sprintf("unknown action %q", name.Value)}
+		}
+		return a, nil
+	}
+	guard := func(name Name) (fsm.Guard[C], error) {
+		if name.Value == "" {
+			return nil, nil
+		}
+		g, ok := bindings.Guards[name.Value]
+		if !ok {
+			return nil, &Error{Line: name.Line, Msg: fmt.Sprintf("unknown guard %q", name.Value)}
+		}
+		return g, nil
+	}
+
+	for _, def := range m.States {
+		id := fsm.StateID(def.ID.Value)
+		if _, ok := states[id]; ok {
+			return nil, &Error{Line: def.ID.Line, Msg: fmt.Sprintf("duplicate state %q", id)}
+		}
+
+		var state fsm.State[C]
+		var err error
+		if state.Action, err = action(def.Action); err != nil {
+			return nil, err
+		}
+		if state.OnEnter, err = action(def.OnEnter); err != nil {
+			return nil, err
+		}
+		if state.OnExit, err = action(def.OnExit); err != nil {
+			return nil, err
+		}
+
+		state.Parent = fsm.StateID(def.Parent.Value)
+		state.Initial = fsm.StateID(def.Initial.Value)
+
+		if def.Timeout.Value != "" {
+			state.Timeout, err = time.ParseDuration(def.Timeout.Value)
+			if err != nil || state.Timeout <= 0 {
+				return nil, &Error{Line: def.Timeout.Line, Msg: fmt.Sprintf("invalid timeout %q", def.Timeout.Value)}
+			}
+		}
+		state.TimeoutEvent = fsm.EventID(def.TimeoutEvent.Value)
+
+		for _, event := range def.Emits {
+			state.Emits = append(state.Emits, fsm.EventID(event.Value))
+		}
+		for _, event := range def.Defer {
+			state.Defer = append(state.Defer, fsm.EventID(event.Value))
+		}
+
+		if len(def.Events) > 0 {
+			state.Events = make(fsm.Events, len(def.Events))
+			for _, edge := range def.Events {
+				state.Events[fsm.EventID(edge.Event.Value)] = fsm.StateID(edge.Target.Value)
+			}
+		}
+
+		if len(def.Transitions) > 0 {
+			state.Transitions = make(fsm.Transitions[C], len(def.Transitions))
+			for _, guarded := range def.Transitions {
+				var candidates []fsm.Transition[C]
+				for _, t := range guarded.Transitions {
+					if t.Target.Value == "" {
+						return nil, &Error{Line: t.Line, Msg: "transition has no target"}
+					}
+					candidate := fsm.Transition[C]{Target: fsm.StateID(t.Target.Value)}
+					if candidate.Guard, err = guard(t.Guard); err != nil {
+						return nil, err
+					}
+					if candidate.Action, err = action(t.Action); err != nil {
+						return nil, err
+					}
+					candidates = append(candidates, candidate)
+				}
+				state.Transitions[fsm.EventID(guarded.Event.Value)] = candidates
+			}
+		}
+
+		states[id] = state
+	}
+
+	return states, nil
+}
@@ -0,0 +1,170 @@
+package spec
+
+// To run tests
+// $ go test -v ./...
+//
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+)
+
+// countAction counts how many times it is executed.
+type countAction struct {
+	count int
+}
+
+func (a *countAction) Execute(ctx *int) fsm.EventID {
+	a.count += 1
+	return fsm.NoOp
+}
+
+func bindings() fsm.Bindings[*int] {
+	return fsm.Bindings[*int]{
+		Actions: map[string]fsm.Action[*int]{
+			"Count": &countAction{},
+		},
+		Guards: map[string]fsm.Guard[*int]{
+			"Short": func(gap *int, event fsm.Event) bool { return *gap < 10 },
+		},
+	}
+}
+
+const doc = `name: test
+states:
+  DEFAULT:
+    action: Count
+    transitions:
+      Go:
+        - target: Fast
+          guard: Short
+        - target: Slow
+  Present:
+    initial: Fast
+    timeout: 5s
+    timeoutEvent: Timeout
+    events:
+      Timeout: DEFAULT
+  Fast:
+    parent: Present
+    action: Count
+    defer: [Go]
+  Slow:
+    parent: Present
+    action: Count
+`
+
+func TestLoad(t *testing.T) {
+
+	states, err := Load(strings.NewReader(doc), bindings())
+	if err != nil {
+		t.Fatalf("load\nexpected: <nil>\ngot:      %v", err)
+	}
+
+	if p := states["Present"]; p.Timeout != 5*time.Second || p.TimeoutEvent != "Timeout" || p.Initial != "Fast" {
+		t.Errorf("Present\nexpected: 5s Timeout Fast\ngot:      %v %v %v", p.Timeout, p.TimeoutEvent, p.Initial)
+	}
+
+	if d := states["Fast"].Defer; len(d) != 1 || d[0] != "Go" {
+		t.Errorf("Fast defer\nexpected: [Go]\ngot:      %v", d)
+	}
+
+	candidates := states[fsm.Default].Transitions["Go"]
+	if len(candidates) != 2 || candidates[0].Target != "Fast" || candidates[0].Guard == nil ||
+		candidates[1].Target != "Slow" || candidates[1].Guard != nil {
+		t.Errorf("Go transitions\nexpected: Fast if Short, then Slow\ngot:      %+v", candidates)
+	}
+
+	gap := 50
+	sm := &fsm.StateMachine[*int]{Current: fsm.Default, States: states}
+	if err := sm.SendEvent("Go", &gap); err != nil || sm.Current != "Slow" {
+		t.Errorf("send\nexpected: Slow <nil>\ngot:      %v %v", sm.Current, err)
+	}
+
+	//
+	// JSON documents load the same way
+	//
+	json := `{
+	"states": {
+		"DEFAULT": {"action": "Count", "events": {"Go": "Done"}},
+		"Done": {"action": "Count", "events": {"Reset": "DEFAULT"}}
+	}
+}`
+	if _, err := Load(strings.NewReader(json), bindings()); err != nil {
+		t.Errorf("json\nexpected: <nil>\ngot:      %v", err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		doc  string
+		line int
+		msg  string
+	}{
+		{
+			name: "unknown field",
+			doc:  "states:\n  DEFAULT:\n    action: Count\n    evnets: {}\n",
+			line: 4,
+			msg:  `unknown field "evnets"`,
+		},
+		{
+			name: "unknown action",
+			doc:  "states:\n  DEFAULT:\n    action: Count\n    onExit: Cleanup\n",
+			line: 4,
+			msg:  `unknown action "Cleanup"`,
+		},
+		{
+			name: "unknown guard",
+			doc:  "states:\n  DEFAULT:\n    action: Count\n    transitions:\n      Go:\n        - target: DEFAULT\n          guard: Long\n",
+			line: 7,
+			msg:  `unknown guard "Long"`,
+		},
+		{
+			name: "bad timeout",
+			doc:  "states:\n  DEFAULT:\n    action: Count\n    timeout: soon\n",
+			line: 4,
+			msg:  `invalid timeout "soon"`,
+		},
+		{
+			name: "missing target",
+			doc:  "states:\n  DEFAULT:\n    action: Count\n    events:\n      Go: Nowhere\n",
+			line: 5,
+			msg:  `state "DEFAULT" goes to missing state "Nowhere" on "Go"`,
+		},
+		{
+			name: "missing guarded target",
+			doc:  "states:\n  DEFAULT:\n    action: Count\n    transitions:\n      Go:\n        - target: DEFAULT\n          guard: Short\n        - target: Nowhere\n",
+			line: 8,
+			msg:  `state "DEFAULT" goes to missing state "Nowhere" on "Go"`,
+		},
+		{
+			name: "unreachable state",
+			doc:  "states:\n  DEFAULT:\n    action: Count\n    events:\n      Go: DEFAULT\n  Lost:\n    action: Count\n    events:\n      Go: DEFAULT\n",
+			line: 6,
+			msg:  `state "Lost" is unreachable`,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Load(strings.NewReader(test.doc), bindings())
+
+		var specErr *Error
+		if !errors.As(err, &specErr) || specErr.Line != test.line || specErr.Msg != test.msg {
+			t.Errorf("%v\nexpected: line %v: %v\ngot:      %v", test.name, test.line, test.msg, err)
+		}
+	}
+
+	//
+	// Documents that parse are validated
+	//
+	_, err := Load(strings.NewReader("states:\n  DEFAULT:\n    action: Count\n    events:\n      Go: Nowhere\n"), bindings())
+	if !errors.Is(err, fsm.ErrEventConfig) {
+		t.Errorf("validate\nexpected: %v\ngot:      %v", fsm.ErrEventConfig, err)
+	}
+}
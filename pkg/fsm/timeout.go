@@ -0,0 +1,71 @@
+package fsm
+
+// pendingTimeout is a timeout armed when a state was entered.
+type pendingTimeout struct {
+	timer Timer
+	entry uint64
+}
+
+// clock returns the machine's clock.
+func (s *StateMachine[C]) clock() Clock {
+	if s.Clock == nil {
+		return SystemClock
+	}
+	return s.Clock
+}
+
+// startTimeout arms the timeout of a state being entered, if it has one. The
+// caller must hold the mutex.
+func (s *StateMachine[C]) startTimeout(id StateID) {
+	s.entries += 1
+
+	state := s.states()[id]
+	if state.Timeout <= 0 {
+		return
+	}
+
+	if s.timers == nil {
+		s.timers = make(map[StateID]pendingTimeout)
+	}
+
+	entry := s.entries
+	s.timers[id] = pendingTimeout{
+		timer: s.clock().AfterFunc(state.Timeout, func() { s.fireTimeout(id, entry) }),
+		entry: entry,
+	}
+}
+
+// stopTimeout cancels the timeout of a state being exited. The caller must hold
+// the mutex.
+func (s *StateMachine[C]) stopTimeout(id StateID) {
+	if pending, ok := s.timers[id]; ok {
+		pending.timer.Stop()
+		delete(s.timers, id)
+	}
+}
+
+// stopAll cancels every pending timeout and scheduled event. The caller must
+// hold the mutex.
+func (s *StateMachine[C]) stopAll() {
+	for id := range s.timers {
+		s.stopTimeout(id)
+	}
+	s.cancelAllScheduled()
+}
+
+// fireTimeout sends the timeout event of a state, unless the machine has left
+// the state since the timeout was armed.
+func (s *StateMachine[C]) fireTimeout(id StateID, entry uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pending, ok := s.timers[id]
+	if !ok || pending.entry != entry {
+		return
+	}
+	delete(s.timers, id)
+
+	s.origin = OriginTimeout
+	defer func() { s.origin = OriginSent }()
+	s.handler()(Event{ID: s.states()[id].TimeoutEvent}, s.eventCtx)
+}
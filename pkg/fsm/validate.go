@@ -0,0 +1,318 @@
+package fsm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidationError lists every problem found in a definition, Locations[i]
+// telling where Problems[i] is. It matches ErrEventConfig with errors.Is.
+type ValidationError struct {
+	Problems  []string
+	Locations []Location
+}
+
+// Location tells where a problem is in a definition: the state, the field of the
+// state, named after State's fields, and the event and the state it goes to for
+// the problems about events. Problems about the whole definition, or about a
+// state as a whole, leave the fields they don't need empty.
+type Location struct {
+	State  StateID
+	Field  string
+	Event  EventID
+	Target StateID
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrEventConfig, strings.Join(e.Problems, "; "))
+}
+
+// Is reports whether target is ErrEventConfig.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrEventConfig
+}
+
+// Validate checks the definition and reports every problem it finds at once:
+// states that are targeted but missing, states without an action, states that
+// can't be reached from Default, states with no way out, events returned by
+// actions or timeouts that the state does not accept, deferred events that the
+// state accepts anyway, actions that can chain
+// events forever, see ChainCycles, and an Any state with more than events and
+// transitions. Parent states only need an action, or a way out, through their
+// children. It returns nil or a *ValidationError.
+func (s States[C]) Validate() error {
+	return s.validate(nil)
+}
+
+// Validate checks the machine's States like States.Validate, along with its
+// error state when Reject is EnterErrorState and its failure state if it has
+// one. Those states count as reachable.
+func (s *StateMachine[C]) Validate() error {
+	var problems []string
+	var locations []Location
+	var roots []StateID
+	check := func(kind string, id StateID) {
+		if _, ok := s.states()[id]; !ok || id == Any {
+			problems = append(problems, fmt.Sprintf("%v state %q is missing", kind, id))
+			locations = append(locations, Location{})
+		} else if s.states()[id].Initial == "" && s.states().hasChildren(id) {
+			problems = append(problems, fmt.Sprintf("%v state %q has children but no initial state", kind, id))
+			locations = append(locations, Location{State: id})
+		}
+		roots = append(roots, id)
+	}
+
+	if s.Reject == EnterErrorState {
+		check("error", s.ErrorState)
+	}
+	if s.FailureState != "" {
+		check("failure", s.FailureState)
+	}
+
+	if err := s.states().validate(roots); err != nil {
+		problems = append(problems, err.(*ValidationError).Problems...)
+		locations = append(locations, err.(*ValidationError).Locations...)
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems, Locations: locations}
+	}
+	return nil
+}
+
+// validate checks the definition, counting the roots as reachable along with
+// Default.
+func (s States[C]) validate(roots []StateID) error {
+	var problems []string
+	var locations []Location
+	report := func(at Location, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+		locations = append(locations, at)
+	}
+
+	if _, ok := s[Default]; !ok {
+		report(Location{}, "default state %q is missing", Default)
+	}
+
+	parents := make(map[StateID]bool)
+	for _, state := range s {
+		if state.Parent != "" {
+			parents[state.Parent] = true
+		}
+	}
+
+	checkTargets := func(id StateID, state State[C]) {
+		check := func(field string, event EventID, target StateID) {
+			at := Location{State: id, Field: field, Event: event, Target: target}
+			if _, ok := s[target]; !ok || target == Any {
+				report(at, "state %q goes to missing state %q on %q", id, target, event)
+			} else if parents[target] && s[target].Initial == "" {
+				report(at, "state %q goes to state %q on %q that has children but no initial state", id, target, event)
+			}
+		}
+		for _, event := range sortedEvents(state.Events) {
+			check("Events", event, state.Events[event])
+		}
+		for _, event := range sortedEvents(state.Transitions) {
+			for _, t := range state.Transitions[event] {
+				check("Transitions", event, t.Target)
+			}
+		}
+	}
+
+	if state, ok := s[Any]; ok {
+		if state.Action != nil || state.OnEnter != nil || state.OnExit != nil || state.Parent != "" ||
+			state.Initial != "" || state.Timeout != 0 || len(state.Emits) > 0 || len(state.Defer) > 0 || parents[Any] {
+			report(Location{State: Any}, "wildcard state %q can only have events and transitions", Any)
+		}
+		checkTargets(Any, state)
+	}
+
+	for _, id := range s.ids() {
+		state := s[id]
+
+		if state.Parent != "" {
+			if _, ok := s[state.Parent]; !ok {
+				report(Location{State: id, Field: "Parent"}, "state %q has missing parent %q", id, state.Parent)
+			} else if s.isAncestor(id, id) {
+				report(Location{State: id, Field: "Parent"}, "state %q is its own ancestor", id)
+			}
+		}
+
+		if state.Initial != "" {
+			if child, ok := s[state.Initial]; !ok {
+				report(Location{State: id, Field: "Initial"}, "state %q has missing initial state %q", id, state.Initial)
+			} else if child.Parent != id {
+				report(Location{State: id, Field: "Initial"}, "state %q has initial state %q that is not its child", id, state.Initial)
+			}
+		} else if !parents[id] && state.Action == nil {
+			report(Location{State: id}, "state %q has no action", id)
+		}
+
+		checkTargets(id, state)
+
+		if state.Timeout > 0 {
+			if state.TimeoutEvent == "" {
+				report(Location{State: id, Field: "Timeout"}, "state %q has a timeout but no timeout event", id)
+			} else if !s.accepts(id, state.TimeoutEvent) {
+				report(Location{State: id, Field: "TimeoutEvent", Event: state.TimeoutEvent},
+					"state %q times out with event %q that it does not accept", id, state.TimeoutEvent)
+			}
+		}
+
+		for _, event := range state.Emits {
+			if !s.accepts(id, event) {
+				report(Location{State: id, Field: "Emits", Event: event}, "state %q action returns event %q that it does not accept", id, event)
+			}
+		}
+
+		for _, event := range state.Defer {
+			if s.accepts(id, event) {
+				report(Location{State: id, Field: "Defer", Event: event}, "state %q defers event %q that it accepts", id, event)
+			}
+		}
+
+		if !parents[id] && !s.hasWayOut(id) {
+			report(Location{State: id}, "state %q is a dead end", id)
+		}
+	}
+
+	for _, cycle := range s.ChainCycles() {
+		id := cycle[len(cycle)-1].State
+		report(Location{State: id}, "state %q can chain events forever: %v", id, formatChain(cycle))
+	}
+
+	reachable := s.reachable(roots)
+	for _, id := range s.ids() {
+		if !reachable[id] {
+			report(Location{State: id}, "state %q is unreachable", id)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems, Locations: locations}
+	}
+	return nil
+}
+
+// ids returns the state IDs in a stable order, leaving out Any.
+func (s States[C]) ids() []StateID {
+	ids := make([]StateID, 0, len(s))
+	for id := range s {
+		if id != Any {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// hasChildren reports whether any state has id as its parent.
+func (s States[C]) hasChildren(id StateID) bool {
+	for _, state := range s {
+		if state.Parent == id {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedEvents returns the keys of an Events or Transitions map in a stable order.
+func sortedEvents[V any](m map[EventID]V) []EventID {
+	events := make([]EventID, 0, len(m))
+	for event := range m {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	return events
+}
+
+// isAncestor reports whether ancestor is a parent, grandparent and so on of id.
+// A state whose parents loop back to it is its own ancestor.
+func (s States[C]) isAncestor(ancestor, id StateID) bool {
+	seen := make(map[StateID]bool)
+	for p := s[id].Parent; p != "" && !seen[p]; p = s[p].Parent {
+		if p == ancestor {
+			return true
+		}
+		seen[p] = true
+	}
+	return false
+}
+
+// accepts reports whether the state, one of its parents or Any handles the event.
+func (s States[C]) accepts(id StateID, event EventID) bool {
+	for _, p := range s.handlers(id) {
+		state := s[p]
+		if _, ok := state.Events[event]; ok {
+			return true
+		}
+		if _, ok := state.Transitions[event]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasWayOut reports whether the state, one of its parents or Any handles any
+// event, or whether the state or one of its parents has a timeout.
+func (s States[C]) hasWayOut(id StateID) bool {
+	for _, p := range s.handlers(id) {
+		state := s[p]
+		if len(state.Events) > 0 || len(state.Transitions) > 0 || state.Timeout > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// targets returns every state the given state can move to directly, through its
+// own events or those of its parents and Any.
+func (s States[C]) targets(id StateID) []StateID {
+	var targets []StateID
+	for _, p := range s.handlers(id) {
+		state := s[p]
+		for _, event := range sortedEvents(state.Events) {
+			targets = append(targets, state.Events[event])
+		}
+		for _, event := range sortedEvents(state.Transitions) {
+			for _, t := range state.Transitions[event] {
+				targets = append(targets, t.Target)
+			}
+		}
+	}
+	return targets
+}
+
+// reachable returns the states that can be reached from Default and the roots,
+// including the parents of every state reached.
+func (s States[C]) reachable(roots []StateID) map[StateID]bool {
+	reachable := make(map[StateID]bool)
+	var queue []StateID
+
+	visit := func(target StateID) {
+		chain := s.initial(target)
+		for _, id := range s.path(chain[len(chain)-1]) {
+			if _, ok := s[id]; ok && !reachable[id] {
+				reachable[id] = true
+				queue = append(queue, id)
+			}
+		}
+	}
+
+	visit(Default)
+	for _, root := range roots {
+		if _, ok := s[root]; ok && root != Any {
+			visit(root)
+		}
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, target := range s.targets(id) {
+			visit(target)
+		}
+	}
+
+	return reachable
+}
@@ -1,27 +1,29 @@
 package marty
 
+// The states, events, timeouts, States and Bindings are generated from
+// marty.yaml, the actions are written by hand below.
+//go:generate go run ../../cmd/fsmgen -context Context marty.yaml
+
 import (
 	"fmt"
-	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/tonygilkerson/marty/pkg/fsm"
 )
 
 const (
-	// States
-	Arriving   fsm.StateID = "Arriving"
-	Arrived    fsm.StateID = "Arrived"
-	Departing  fsm.StateID = "Departing"
-	Departed   fsm.StateID = "Departed"
-	FalseAlarm fsm.StateID = "FalseAlarm"
-	Error      fsm.StateID = "Error"
-
-	//Events
-	FarRising   fsm.EventID = "FarRising"
-	FarFalling  fsm.EventID = "FarFalling"
-	NearRising  fsm.EventID = "NearRising"
-	NearFalling fsm.EventID = "NearFalling"
-	Reset       fsm.EventID = "Reset"
+	// PassingTimeout is how long a vehicle can take to pass both beams before
+	// the detection is given up as a false alarm, the timeout of VehiclePresent
+	// in marty.yaml
+	PassingTimeout = VehiclePresentTimeout
+
+	// Metrics messages
+	StateMetricsMsg      = "MartyState"
+	TransitionMetricsMsg = "MartyTransition"
+	RejectedMetricsMsg   = "MartyRejected"
 )
 
 type Context struct {
@@ -32,6 +34,14 @@ type Context struct {
 	DepartingCount  int
 	ErrorCount      int
 	FalseAlarmCount int
+
+	// RejectedEvent and RejectedFrom are the last out of order event and the
+	// state it came in, the one that led to the Error state.
+	RejectedEvent fsm.EventID
+	RejectedFrom  fsm.StateID
+
+	// LastFailure is the last action failure, the one that led to the Error state.
+	LastFailure string
 }
 
 func (c *Context) String() string {
@@ -40,10 +50,13 @@ func (c *Context) String() string {
 }
 
 type Marty struct {
-	StateMachine fsm.StateMachine
+	StateMachine *fsm.StateMachine[*Context]
 	Ctx          Context
-}
 
+	// Metrics collects how long each state lasts and how often each transition
+	// fires, see MetricsMessages.
+	Metrics *fsm.Metrics
+}
 
 func (m *Marty) ResetContext() {
 	m.Ctx = Context{
@@ -54,97 +67,146 @@ func (m *Marty) ResetContext() {
 		DepartingCount:  0,
 		ErrorCount:      0,
 		FalseAlarmCount: 0,
+		RejectedEvent:   "",
+		RejectedFrom:    "",
+		LastFailure:     "",
 	}
 }
 
-// // MarshallMetrics will format the Context into a message that can be sent
-// func (m *Marty) MarshallMetrics() string {
-// 	msg := fmt.Sprintf("mbx|%d|%d|%d|%d",
-// 		m.Ctx.ArrivedCount,
-// 		m.Ctx.DepartedCount,
-// 		m.Ctx.ErrorCount,
-// 		m.Ctx.FalseAlarmCount,
-// 	)
+// RecordRejected records an out of order event before the Error state is
+// entered.
+func (c *Context) RecordRejected(event fsm.EventID, from fsm.StateID) {
+	c.RejectedEvent = event
+	c.RejectedFrom = from
+}
 
-// 	return msg
-// }
+// RecordFailure records a failed action before the Error state is entered.
+func (c *Context) RecordFailure(err *fsm.ActionError) {
+	c.LastFailure = err.Error()
+}
 
-// // UnmarshallMetrics will unmarshall a message that was produced by MarshallMetrics
-// func UnmarshallMetrics(msg string) Context {
+// Snapshot returns the state machine and a copy of the counters so that they
+// can be persisted, and restored after a reboot with Restore. Encoding them is
+// left to the storage backend.
+func (m *Marty) Snapshot() fsm.Snapshot[*Context] {
+	ctx := m.Ctx
+	return m.StateMachine.Snapshot(&ctx)
+}
 
-// 	var ctx Context
+// Restore restores the state machine and the counters of a snapshot taken with
+// Snapshot. Nothing changes if the snapshot doesn't match the state machine
+// definition.
+func (m *Marty) Restore(snap fsm.Snapshot[*Context]) error {
+	if snap.Context == nil {
+		return fmt.Errorf("%w: no context", fsm.ErrSnapshot)
+	}
 
-// 	msgParts := strings.Split(msg, "|")
+	ctx := *snap.Context
+	snap.Context = &m.Ctx
+	if err := m.StateMachine.Restore(snap); err != nil {
+		return err
+	}
+	m.Ctx = ctx
+
+	return nil
+}
 
-// 	if msgParts[0] != "mbx" {
-// 		log.Printf("expected metrics message got: %v\n", msg)
-// 		return ctx
-// 	}
+// Status formats the detection state into a message for the gateway's status
+// command: the current and previous state and the events expected next.
+func (m *Marty) Status() string {
+	var events []string
+	for _, event := range m.StateMachine.AvailableEvents() {
+		events = append(events, string(event))
+	}
 
-// 	ctx.ArrivedCount, _ = strconv.Atoi(msgParts[1])
-// 	ctx.DepartedCount, _ = strconv.Atoi(msgParts[2])
-// 	ctx.ErrorCount, _ = strconv.Atoi(msgParts[3])
-// 	ctx.FalseAlarmCount, _ = strconv.Atoi(msgParts[4])
+	return fmt.Sprintf("status|%v|%v|%v",
+		m.StateMachine.CurrentState(),
+		m.StateMachine.PreviousState(),
+		strings.Join(events, ","),
+	)
+}
 
-// 	return ctx
-// }
+// MetricsMessages returns the metrics collected since the last call as messages
+// for the gateway, see FormatMetrics, and starts them over.
+func (m *Marty) MetricsMessages() []string {
+	return FormatMetrics(m.Metrics.Reset())
+}
+
+// FormatMetrics formats metrics as messages for the gateway, in a stable order:
+//
+//	MartyState:<state>|<entries>|<visits>|<dwell ms>|<histogram counts>
+//	MartyTransition:<from>|<event>|<to>|<count>
+//	MartyRejected:<event>|<count>
+//
+// The histogram counts are separated by commas, in the order of the buckets.
+func FormatMetrics(snap fsm.MetricsSnapshot) []string {
+	var msgs []string
+
+	for id, state := range snap.States {
+		counts := make([]string, len(state.Histogram))
+		for i, count := range state.Histogram {
+			counts[i] = strconv.Itoa(count)
+		}
+		msgs = append(msgs, fmt.Sprintf("%v:%v|%d|%d|%d|%v", StateMetricsMsg, id,
+			state.Entries, state.Visits, state.Dwell.Milliseconds(), strings.Join(counts, ",")))
+	}
+	for key, count := range snap.Transitions {
+		msgs = append(msgs, fmt.Sprintf("%v:%v|%v|%v|%d", TransitionMetricsMsg, key.From, key.Event, key.To, count))
+	}
+	for event, count := range snap.Rejected {
+		msgs = append(msgs, fmt.Sprintf("%v:%v|%d", RejectedMetricsMsg, event, count))
+	}
+
+	sort.Strings(msgs)
+	return msgs
+}
 
 // DefaultAction
 type DefaultAction struct{}
 
-func (a *DefaultAction) Execute(eventCtx fsm.EventContext) fsm.EventID {
+func (a *DefaultAction) Execute(ctx *Context) fsm.EventID {
 
-	ctx := eventCtx.(*Context)
 	ctx.DefaultCount += 1
 
-	log.Printf("DefaultAction\n")
 	return fsm.NoOp
 }
 
 // ArrivedAction
 type ArrivedAction struct{}
 
-func (a *ArrivedAction) Execute(eventCtx fsm.EventContext) fsm.EventID {
+func (a *ArrivedAction) Execute(ctx *Context) fsm.EventID {
 
-	ctx := eventCtx.(*Context)
 	ctx.ArrivedCount += 1
 
-	log.Printf("ArrivedAction\n")
 	return Reset
 }
 
 type DepartedAction struct{}
 
-func (a *DepartedAction) Execute(eventCtx fsm.EventContext) fsm.EventID {
+func (a *DepartedAction) Execute(ctx *Context) fsm.EventID {
 
-	ctx := eventCtx.(*Context)
 	ctx.DepartedCount += 1
 
-	log.Printf("DepartedAction\n")
 	return Reset
 }
 
 // ArrivingAction
 type ArrivingAction struct{}
 
-func (a *ArrivingAction) Execute(eventCtx fsm.EventContext) fsm.EventID {
+func (a *ArrivingAction) Execute(ctx *Context) fsm.EventID {
 
-	ctx := eventCtx.(*Context)
 	ctx.ArrivingCount += 1
 
-	log.Printf("ArrivingAction\n")
 	return fsm.NoOp
 }
 
 // DepartingAction
 type DepartingAction struct{}
 
-func (a *DepartingAction) Execute(eventCtx fsm.EventContext) fsm.EventID {
+func (a *DepartingAction) Execute(ctx *Context) fsm.EventID {
 
-	ctx := eventCtx.(*Context)
 	ctx.DepartingCount += 1
 
-	log.Printf("DepartingAction\n")
 	return fsm.NoOp
 }
 
@@ -153,83 +215,82 @@ func (a *DepartingAction) Execute(eventCtx fsm.EventContext) fsm.EventID {
 // ErrorAction
 type ErrorAction struct{}
 
-func (a *ErrorAction) Execute(eventCtx fsm.EventContext) fsm.EventID {
+func (a *ErrorAction) Execute(ctx *Context) fsm.EventID {
 
-	ctx := eventCtx.(*Context)
 	ctx.ErrorCount += 1
 
-	log.Printf("ErrorAction\n")
 	return fsm.NoOp
 }
 
 // FalseAlarmAction
 type FalseAlarmAction struct{}
 
-func (a *FalseAlarmAction) Execute(eventCtx fsm.EventContext) fsm.EventID {
+func (a *FalseAlarmAction) Execute(ctx *Context) fsm.EventID {
 
-	ctx := eventCtx.(*Context)
 	ctx.FalseAlarmCount += 1
 
-	log.Printf("FalseAlarmAction\n")
 	return Reset
 }
 
+var (
+	definition     *fsm.Definition[*Context]
+	definitionOnce sync.Once
+)
+
+// Definition returns the marty detection flow compiled once and shared by every
+// Marty returned by New.
+func Definition() *fsm.Definition[*Context] {
+	definitionOnce.Do(func() {
+		var err error
+		definition, err = fsm.Compile(States(), fsm.MachineConfig{
+			Reject:       fsm.EnterErrorState,
+			ErrorState:   Error,
+			FailureState: Error,
+		})
+		if err != nil {
+			panic(err)
+		}
+	})
+	return definition
+}
+
+// New returns a Marty in the default state.
 func New() *Marty {
 
 	var marty Marty
-	marty.StateMachine = fsm.StateMachine{
-		Current:  fsm.Default,
-		Previous: fsm.Default,
-		States: fsm.States{
-
-			fsm.Default: fsm.State{
-				Action: &DefaultAction{},
-				Events: fsm.Events{
-					FarRising:   Arriving,
-					NearRising:  Departing,
-					FarFalling:  fsm.Default,
-					NearFalling: fsm.Default,
-				},
-			},
-
-			Arriving: fsm.State{
-				Action: &ArrivingAction{},
-				Events: fsm.Events{
-					FarFalling: FalseAlarm,
-					NearRising: Arrived,
-				},
-			},
-
-			Arrived: fsm.State{
-				Action: &ArrivedAction{},
-				Events: fsm.Events{
-					Reset: fsm.Default,
-				},
-			},
-
-			Departing: fsm.State{
-				Action: &DepartingAction{},
-				Events: fsm.Events{
-					NearFalling: FalseAlarm,
-					FarRising:   Departed,
-				},
-			},
-
-			Departed: fsm.State{
-				Action: &DepartedAction{},
-				Events: fsm.Events{
-					Reset: fsm.Default,
-				},
-			},
-
-			FalseAlarm: fsm.State{
-				Action: &FalseAlarmAction{},
-				Events: fsm.Events{
-					Reset: fsm.Default,
-				},
-			},
-		},
+	marty.StateMachine = Definition().NewInstance()
+	marty.StateMachine.AddObserver(fsm.NewLogObserver("marty"))
+	marty.Metrics = marty.StateMachine.CollectMetrics()
+
+	return &marty
+}
+
+// NewRegistry returns a registry with a detection flow per mailbox node, for a
+// gateway that hears from more than one. The log of each flow is prefixed with
+// its node ID.
+func NewRegistry() *fsm.Registry[string, *Context] {
+	return fsm.NewRegistry(Definition(), func(node string, machine *fsm.StateMachine[*Context]) *Context {
+		machine.AddObserver(fsm.NewLogObserver("marty " + node))
+		return &Context{}
+	})
+}
+
+// NewWithStates returns a Marty that runs an alternative detection flow, such
+// as one loaded with package spec. Events the flow doesn't expect and actions
+// that fail lead to the Error state, which the flow must define.
+func NewWithStates(states fsm.States[*Context]) *Marty {
+
+	var marty Marty
+	marty.StateMachine = &fsm.StateMachine[*Context]{
+		Current:      fsm.Default,
+		Previous:     fsm.Default,
+		States:       states,
+		Reject:       fsm.EnterErrorState,
+		ErrorState:   Error,
+		FailureState: Error,
 	}
+	marty.StateMachine.AddObserver(fsm.NewLogObserver("marty"))
+	marty.Metrics = marty.StateMachine.CollectMetrics()
 
 	return &marty
 }
@@ -5,7 +5,16 @@ package marty
 //
 
 import (
+	"encoding/json"
+	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/tonygilkerson/marty/pkg/fsm"
+	"github.com/tonygilkerson/marty/pkg/fsm/fsmcheck"
+	"github.com/tonygilkerson/marty/pkg/fsm/fsmtrace"
+	"github.com/tonygilkerson/marty/pkg/fsm/spec"
 )
 
 func TestMartyStateMachine(t *testing.T) {
@@ -19,8 +28,8 @@ func TestMartyStateMachine(t *testing.T) {
 	t.Logf("----------------------------------\n")
 	m = New()
 	m.ResetContext()
-	m.StateMachine.SendEvent(FarRising,m.Ctx)
-	m.StateMachine.SendEvent(NearRising,m.Ctx)
+	m.StateMachine.SendEvent(FarRising,&m.Ctx)
+	m.StateMachine.SendEvent(NearRising,&m.Ctx)
 
 	if m.Ctx.DefaultCount == 1 &&
 		m.Ctx.ArrivedCount == 1 &&
@@ -40,8 +49,8 @@ func TestMartyStateMachine(t *testing.T) {
 	t.Logf("----------------------------------\n")
 	m = New()
 	m.ResetContext()
-	m.StateMachine.SendEvent(NearRising,m.Ctx)
-	m.StateMachine.SendEvent(FarRising,m.Ctx)
+	m.StateMachine.SendEvent(NearRising,&m.Ctx)
+	m.StateMachine.SendEvent(FarRising,&m.Ctx)
 
 	if m.Ctx.DefaultCount == 1 &&
 		m.Ctx.ArrivedCount == 0 &&
@@ -62,8 +71,8 @@ func TestMartyStateMachine(t *testing.T) {
 	t.Logf("----------------------------------\n")
 	m = New()
 	m.ResetContext()
-	m.StateMachine.SendEvent(FarRising,m.Ctx)
-	m.StateMachine.SendEvent(FarFalling,m.Ctx)
+	m.StateMachine.SendEvent(FarRising,&m.Ctx)
+	m.StateMachine.SendEvent(FarFalling,&m.Ctx)
 
 	if m.Ctx.DefaultCount == 1 &&
 		m.Ctx.ArrivedCount == 0 &&
@@ -83,8 +92,8 @@ func TestMartyStateMachine(t *testing.T) {
 	t.Logf("----------------------------------\n")
 	m = New()
 	m.ResetContext()
-	m.StateMachine.SendEvent(NearRising,m.Ctx)
-	m.StateMachine.SendEvent(NearFalling,m.Ctx)
+	m.StateMachine.SendEvent(NearRising,&m.Ctx)
+	m.StateMachine.SendEvent(NearFalling,&m.Ctx)
 
 	if m.Ctx.DefaultCount == 1 &&
 		m.Ctx.ArrivedCount == 0 &&
@@ -105,8 +114,8 @@ func TestMartyStateMachine(t *testing.T) {
 	t.Logf("----------------------------------\n")
 	m = New()
 	m.ResetContext()
-	m.StateMachine.SendEvent(NearRising,m.Ctx)
-	m.StateMachine.SendEvent(NearRising,m.Ctx)
+	m.StateMachine.SendEvent(NearRising,&m.Ctx)
+	m.StateMachine.SendEvent(NearRising,&m.Ctx)
 
 	if m.Ctx.DefaultCount == 0 &&
 		m.Ctx.ArrivedCount == 0 &&
@@ -127,8 +136,8 @@ func TestMartyStateMachine(t *testing.T) {
 	t.Logf("----------------------------------\n")
 	m = New()
 	m.ResetContext()
-	m.StateMachine.SendEvent(FarRising,m.Ctx)
-	m.StateMachine.SendEvent(FarRising,m.Ctx)
+	m.StateMachine.SendEvent(FarRising,&m.Ctx)
+	m.StateMachine.SendEvent(FarRising,&m.Ctx)
 
 	if m.Ctx.DefaultCount == 0 &&
 		m.Ctx.ArrivedCount == 0 &&
@@ -148,10 +157,10 @@ func TestMartyStateMachine(t *testing.T) {
 	t.Logf("----------------------------------\n")
 	m = New()
 	m.ResetContext()
-	m.StateMachine.SendEvent(NearRising,m.Ctx)
-	m.StateMachine.SendEvent(FarRising,m.Ctx)
-	m.StateMachine.SendEvent(FarFalling,m.Ctx)
-	m.StateMachine.SendEvent(NearFalling,m.Ctx)
+	m.StateMachine.SendEvent(NearRising,&m.Ctx)
+	m.StateMachine.SendEvent(FarRising,&m.Ctx)
+	m.StateMachine.SendEvent(FarFalling,&m.Ctx)
+	m.StateMachine.SendEvent(NearFalling,&m.Ctx)
 
 	if m.Ctx.DefaultCount == 3 &&
 		m.Ctx.ArrivedCount == 0 &&
@@ -173,8 +182,8 @@ func TestMartyStateMachine(t *testing.T) {
 	t.Logf("----------------------------------\n")
 	m = New()
 	m.ResetContext()
-	m.StateMachine.SendEvent(NearRising,m.Ctx)
-	m.StateMachine.SendEvent(FarFalling,m.Ctx)
+	m.StateMachine.SendEvent(NearRising,&m.Ctx)
+	m.StateMachine.SendEvent(FarFalling,&m.Ctx)
 
 
 	if m.Ctx.DefaultCount == 0 &&
@@ -196,8 +205,8 @@ func TestMartyStateMachine(t *testing.T) {
 	t.Logf("----------------------------------\n")
 	m = New()
 	m.ResetContext()
-	m.StateMachine.SendEvent(FarRising,m.Ctx)
-	m.StateMachine.SendEvent(NearFalling,m.Ctx)
+	m.StateMachine.SendEvent(FarRising,&m.Ctx)
+	m.StateMachine.SendEvent(NearFalling,&m.Ctx)
 
 
 	if m.Ctx.DefaultCount == 0 &&
@@ -214,3 +223,375 @@ func TestMartyStateMachine(t *testing.T) {
 
 
 }
+
+func TestMartyDefinition(t *testing.T) {
+
+	m := New()
+	if err := m.StateMachine.Validate(); err != nil {
+		t.Errorf("Definition\nexpected: <nil>\ngot:      %v", err)
+	}
+}
+
+func TestMartySpec(t *testing.T) {
+
+	f, err := os.Open("marty.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	states, err := spec.Load(f, Bindings())
+	if err != nil {
+		t.Fatalf("Load marty.yaml\nexpected: <nil>\ngot:      %v", err)
+	}
+
+	//
+	// The document describes the same flow as New
+	//
+	m := NewWithStates(states)
+	m.ResetContext()
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	m.StateMachine.SendEvent(NearRising, &m.Ctx)
+	m.StateMachine.SendEvent(NearRising, &m.Ctx)
+	m.StateMachine.SendEvent(NearFalling, &m.Ctx)
+
+	if m.Ctx.DefaultCount != 2 ||
+		m.Ctx.ArrivedCount != 1 ||
+		m.Ctx.ArrivingCount != 1 ||
+		m.Ctx.DepartingCount != 1 ||
+		m.Ctx.FalseAlarmCount != 1 {
+		t.Errorf("marty.yaml\nexpected: {DefaultCount:2 ArrivedCount:1 ArrivingCount:1 DepartingCount:1 FalseAlarmCount:1}\ngot:      %+v", m.Ctx)
+	}
+}
+
+func TestMartyTimeout(t *testing.T) {
+
+	//
+	// A car trips the far beam and never reaches the near beam
+	//
+	clock := fsm.NewManualClock(time.Now())
+	m := New()
+	m.StateMachine.Clock = clock
+	m.ResetContext()
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	clock.Advance(PassingTimeout)
+
+	if m.StateMachine.Current != fsm.Default ||
+		m.Ctx.DefaultCount != 1 ||
+		m.Ctx.ArrivingCount != 1 ||
+		m.Ctx.FalseAlarmCount != 1 {
+		t.Errorf("Stuck arriving\nexpected: %v {DefaultCount:1 ArrivingCount:1 FalseAlarmCount:1}\ngot:      %v %+v", fsm.Default, m.StateMachine.Current, m.Ctx)
+	}
+
+	//
+	// A car that gets to the near beam in time is not a false alarm
+	//
+	m = New()
+	m.StateMachine.Clock = clock
+	m.ResetContext()
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	clock.Advance(PassingTimeout / 2)
+	m.StateMachine.SendEvent(NearRising, &m.Ctx)
+	clock.Advance(PassingTimeout)
+
+	if m.Ctx.ArrivedCount != 1 || m.Ctx.FalseAlarmCount != 0 {
+		t.Errorf("Arrived in time\nexpected: {ArrivedCount:1 FalseAlarmCount:0}\ngot:      %+v", m.Ctx)
+	}
+}
+
+func TestMartySensorFault(t *testing.T) {
+
+	//
+	// A sensor fault in the middle of a detection leaves it for the error state
+	//
+	m := New()
+	m.ResetContext()
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	m.StateMachine.SendEvent(SensorFault, &m.Ctx)
+
+	if m.StateMachine.Current != Error || m.Ctx.ErrorCount != 1 {
+		t.Errorf("Sensor fault\nexpected: %v {ErrorCount:1}\ngot:      %v %+v", Error, m.StateMachine.Current, m.Ctx)
+	}
+
+	//
+	// Reset works from the error state too
+	//
+	m.StateMachine.SendEvent(Reset, &m.Ctx)
+
+	if m.StateMachine.Current != fsm.Default || m.Ctx.DefaultCount != 1 {
+		t.Errorf("Reset after fault\nexpected: %v {DefaultCount:1}\ngot:      %v %+v", fsm.Default, m.StateMachine.Current, m.Ctx)
+	}
+}
+
+func TestMartyRejected(t *testing.T) {
+
+	//
+	// An out of order event is recorded along with the state it came in
+	//
+	m := New()
+	m.ResetContext()
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	err := m.StateMachine.SendEvent(NearFalling, &m.Ctx)
+
+	if err != nil ||
+		m.StateMachine.Current != Error ||
+		m.Ctx.RejectedEvent != NearFalling ||
+		m.Ctx.RejectedFrom != Arriving {
+		t.Errorf("Rejected event\nexpected: %v %v %v <nil>\ngot:      %v %v %v %v", Error, NearFalling, Arriving, m.StateMachine.Current, m.Ctx.RejectedEvent, m.Ctx.RejectedFrom, err)
+	}
+
+	//
+	// The error state times out and detection resumes
+	//
+	clock := fsm.NewManualClock(time.Now())
+	m = New()
+	m.StateMachine.Clock = clock
+	m.ResetContext()
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	m.StateMachine.SendEvent(NearFalling, &m.Ctx)
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	if m.StateMachine.Current != Error || m.Ctx.ErrorCount != 1 {
+		t.Errorf("Rejected in error\nexpected: %v {ErrorCount:1}\ngot:      %v %+v", Error, m.StateMachine.Current, m.Ctx)
+	}
+
+	clock.Advance(ErrorTimeout)
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	m.StateMachine.SendEvent(NearRising, &m.Ctx)
+	if m.StateMachine.Current != fsm.Default || m.Ctx.ArrivedCount != 1 {
+		t.Errorf("After error timeout\nexpected: %v {ArrivedCount:1}\ngot:      %v %+v", fsm.Default, m.StateMachine.Current, m.Ctx)
+	}
+}
+
+func TestMartyReplay(t *testing.T) {
+
+	f, err := os.Open("testdata/street.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	trace, err := fsmtrace.ReadTrace(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//
+	// Field data replays the same on the host
+	//
+	m := New()
+	if divergences := fsmtrace.Replay(m.StateMachine, &m.Ctx, trace); len(divergences) != 0 {
+		t.Errorf("Replay\nexpected: []\ngot:      %v", divergences)
+	}
+	expected := Context{DefaultCount: 9, ArrivedCount: 1, ArrivingCount: 2, DepartedCount: 1, DepartingCount: 2,
+		ErrorCount: 1, FalseAlarmCount: 1, RejectedEvent: FarFalling, RejectedFrom: Departing}
+	if diffs := fsmtrace.DiffContexts(expected, m.Ctx); len(diffs) != 0 {
+		t.Errorf("Replay counters\nexpected: %+v\ngot:      %+v", expected, m.Ctx)
+	}
+
+	//
+	// With a longer passing timeout the car that backed out at 07:59 is a false
+	// alarm because of the far beam falling, not the timeout, so the beam falling
+	// no longer leads back to the default state
+	//
+	states := States()
+	state := states[VehiclePresent]
+	state.Timeout = time.Minute
+	states[VehiclePresent] = state
+	longer := NewWithStates(states)
+
+	divergences := fsmtrace.Replay(longer.StateMachine, &longer.Ctx, trace)
+	if len(divergences) != 1 || divergences[0].Index != 9 || divergences[0].State != Arriving {
+		t.Errorf("Longer timeout\nexpected: [#9 Timeout: recorded DEFAULT, replayed Arriving]\ngot:      %v", divergences)
+	}
+	if diffs := fsmtrace.DiffContexts(m.Ctx, longer.Ctx); len(diffs) != 1 || diffs[0] != "DefaultCount: 9 != 8" {
+		t.Errorf("Longer timeout counters\nexpected: [DefaultCount: 9 != 8]\ngot:      %v", diffs)
+	}
+}
+
+func TestMartyStatus(t *testing.T) {
+
+	//
+	// Only the edges of the beam being crossed are expected
+	//
+	m := New()
+	m.ResetContext()
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+
+	expected := "status|Arriving|DEFAULT|FarFalling,NearRising,Reset,SensorFault,Timeout"
+	if status := m.Status(); status != expected {
+		t.Errorf("Status\nexpected: %v\ngot:      %v", expected, status)
+	}
+
+	//
+	// Out of order events can't fire and checking doesn't count anything
+	//
+	ctx := m.Ctx
+	for _, event := range []fsm.EventID{FarRising, NearFalling} {
+		if m.StateMachine.CanFire(fsm.Event{ID: event}, &m.Ctx) {
+			t.Errorf("CanFire %v\nexpected: false\ngot:      true", event)
+		}
+	}
+	if !m.StateMachine.CanFire(fsm.Event{ID: NearRising}, &m.Ctx) || m.Ctx != ctx || m.StateMachine.CurrentState() != Arriving {
+		t.Errorf("CanFire %v\nexpected: true %+v %v\ngot:      false %+v %v", NearRising, ctx, Arriving, m.Ctx, m.StateMachine.CurrentState())
+	}
+}
+
+func TestMartyRegistry(t *testing.T) {
+
+	//
+	// Each node has its own flow and counters
+	//
+	nodes := NewRegistry()
+	nodes.Send("mbx1", fsm.Event{ID: FarRising})
+	nodes.Send("mbx2", fsm.Event{ID: NearRising})
+	nodes.Send("mbx1", fsm.Event{ID: NearRising})
+
+	mbx1, _ := nodes.Get("mbx1")
+	mbx2, _ := nodes.Get("mbx2")
+	if mbx1.Context.ArrivedCount != 1 || mbx1.Machine.CurrentState() != fsm.Default ||
+		mbx2.Context.DepartingCount != 1 || mbx2.Machine.CurrentState() != Departing {
+		t.Errorf("Registry\nexpected: {ArrivedCount:1} %v {DepartingCount:1} %v\ngot:      %+v %v %+v %v", fsm.Default, Departing,
+			*mbx1.Context, mbx1.Machine.CurrentState(), *mbx2.Context, mbx2.Machine.CurrentState())
+	}
+}
+
+func TestMartyActionFailure(t *testing.T) {
+
+	//
+	// A bug in an action leads to the Error state instead of a reboot
+	//
+	states := States()
+	state := states[Arriving]
+	state.Action = fsm.ActionFunc[*Context](func(ctx *Context) fsm.EventID {
+		var beams []int
+		ctx.ArrivingCount += beams[1]
+		return fsm.NoOp
+	})
+	states[Arriving] = state
+
+	m := NewWithStates(states)
+	m.ResetContext()
+	err := m.StateMachine.SendEvent(FarRising, &m.Ctx)
+
+	if err != nil || m.StateMachine.CurrentState() != Error || m.Ctx.ErrorCount != 1 || m.Ctx.LastFailure == "" {
+		t.Errorf("Action failure\nexpected: %v {ErrorCount:1 LastFailure:...} <nil>\ngot:      %v %+v %v", Error, m.StateMachine.CurrentState(), m.Ctx, err)
+	}
+
+	//
+	// Detection carries on after a reset
+	//
+	m.StateMachine.SendEvent(Reset, &m.Ctx)
+	m.StateMachine.SendEvent(NearRising, &m.Ctx)
+	if m.StateMachine.CurrentState() != Departing || m.Ctx.DepartingCount != 1 {
+		t.Errorf("After reset\nexpected: %v {DepartingCount:1}\ngot:      %v %+v", Departing, m.StateMachine.CurrentState(), m.Ctx)
+	}
+}
+
+func TestMartySnapshot(t *testing.T) {
+
+	//
+	// Counters and state survive a reboot
+	//
+	m := New()
+	m.ResetContext()
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	m.StateMachine.SendEvent(NearRising, &m.Ctx)
+	m.StateMachine.SendEvent(NearRising, &m.Ctx)
+
+	// Encoded as JSON, the way a storage backend might
+	saved, err := json.Marshal(m.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap fsm.Snapshot[*Context]
+	if err := json.Unmarshal(saved, &snap); err != nil {
+		t.Fatal(err)
+	}
+
+	rebooted := New()
+	rebooted.ResetContext()
+	if err := rebooted.Restore(snap); err != nil {
+		t.Fatalf("Restore\nexpected: <nil>\ngot:      %v", err)
+	}
+	if rebooted.Ctx != m.Ctx || rebooted.StateMachine.Current != Departing || rebooted.StateMachine.Previous != fsm.Default {
+		t.Errorf("Restore\nexpected: %v %v %+v\ngot:      %v %v %+v", Departing, fsm.Default, m.Ctx,
+			rebooted.StateMachine.Current, rebooted.StateMachine.Previous, rebooted.Ctx)
+	}
+
+	rebooted.StateMachine.SendEvent(FarRising, &rebooted.Ctx)
+	if rebooted.Ctx.DepartedCount != 1 || rebooted.Ctx.DefaultCount != m.Ctx.DefaultCount+1 {
+		t.Errorf("After restore\nexpected: {DepartedCount:1 DefaultCount:%v}\ngot:      %+v", m.Ctx.DefaultCount+1, rebooted.Ctx)
+	}
+}
+
+func TestMartyInvariants(t *testing.T) {
+
+	//
+	// Every vehicle and false alarm is followed by a reset, whatever the beams do
+	//
+	report, err := fsmcheck.Explore(fsmcheck.Config[*Context]{
+		New: func() (*fsm.StateMachine[*Context], *Context) {
+			return Definition().NewInstance(), &Context{}
+		},
+		Invariants: []fsmcheck.Invariant[*Context]{
+			{
+				Name: "no more vehicles than resets",
+				Holds: func(state fsm.StateID, ctx *Context) bool {
+					return ctx.ArrivedCount+ctx.DepartedCount+ctx.FalseAlarmCount <= ctx.DefaultCount
+				},
+			},
+			{
+				Name: "errors are recorded",
+				Holds: func(state fsm.StateID, ctx *Context) bool {
+					return state != Error || ctx.ErrorCount > 0
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		t.Errorf("Invariants\nexpected: <nil>\ngot:      %v", err)
+	}
+	t.Logf("explored %+v", report)
+}
+
+func TestMartyMetrics(t *testing.T) {
+
+	//
+	// A vehicle arriving is reported with how long it took, and a stray timeout
+	//
+	clock := fsm.NewManualClock(time.Now())
+	m := New()
+	m.ResetContext()
+	m.StateMachine.Clock = clock
+	m.Metrics = m.StateMachine.CollectMetrics(time.Second, 10*time.Second)
+
+	clock.Advance(time.Minute)
+	m.StateMachine.SendEvent(FarRising, &m.Ctx)
+	clock.Advance(3 * time.Second)
+	m.StateMachine.SendEvent(NearRising, &m.Ctx)
+	m.StateMachine.SendEvent(Timeout, &m.Ctx)
+
+	expected := []string{
+		"MartyRejected:Timeout|1",
+		"MartyState:Arrived|1|1|0|1,0,0",
+		"MartyState:Arriving|1|1|3000|0,1,0",
+		"MartyState:DEFAULT|1|2|60000|1,0,1",
+		"MartyState:Error|1|0|0|",
+		"MartyState:VehiclePresent|1|1|3000|0,1,0",
+		"MartyTransition:Arrived|Reset|DEFAULT|1",
+		"MartyTransition:Arriving|NearRising|Arrived|1",
+		"MartyTransition:DEFAULT|FarRising|Arriving|1",
+		"MartyTransition:DEFAULT|Timeout|Error|1",
+	}
+	msgs := m.MetricsMessages()
+	if strings.Join(msgs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Metrics\nexpected: %v\ngot:      %v", expected, msgs)
+	}
+
+	//
+	// And only once
+	//
+	if msgs := m.MetricsMessages(); len(msgs) != 0 {
+		t.Errorf("After reset\nexpected: []\ngot:      %v", msgs)
+	}
+}
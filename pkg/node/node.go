@@ -0,0 +1,53 @@
+// Package node runs everything the mailbox node keeps track of as one machine
+// with a region each: car detection, the mailbox door and the charger.
+package node
+
+import (
+	"github.com/tonygilkerson/marty/pkg/charger"
+	"github.com/tonygilkerson/marty/pkg/door"
+	"github.com/tonygilkerson/marty/pkg/fsm"
+	"github.com/tonygilkerson/marty/pkg/marty"
+)
+
+const (
+	// Regions
+	CarRegion     = "car"
+	DoorRegion    = "door"
+	ChargerRegion = "charger"
+)
+
+type Node struct {
+	Regions *fsm.Parallel[*Node]
+
+	Car     *marty.Marty
+	Door    *door.Door
+	Charger *charger.Charger
+}
+
+// New returns a Node whose door and charger regions call notify with the
+// messages for the gateway.
+func New(notify func(msg string)) *Node {
+
+	n := &Node{
+		Car:     marty.New(),
+		Door:    door.New(notify),
+		Charger: charger.New(notify),
+	}
+	n.Regions = fsm.NewParallel(
+		fsm.NewRegion(CarRegion, n.Car.StateMachine, func(n *Node) *marty.Context { return &n.Car.Ctx }),
+		fsm.NewRegion(DoorRegion, n.Door.StateMachine, func(n *Node) *door.Door { return n.Door }),
+		fsm.NewRegion(ChargerRegion, n.Charger.StateMachine, func(n *Node) *charger.Charger { return n.Charger }),
+	)
+
+	return n
+}
+
+// Send sends an event to the regions that handle it.
+func (n *Node) Send(event fsm.EventID) error {
+	return n.Regions.SendEvent(event, n)
+}
+
+// Configuration returns the current state of each region.
+func (n *Node) Configuration() fsm.Configuration {
+	return n.Regions.Configuration()
+}
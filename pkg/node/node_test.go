@@ -0,0 +1,45 @@
+package node
+
+// To run tests
+// $ go test -v ./...
+//
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tonygilkerson/marty/pkg/charger"
+	"github.com/tonygilkerson/marty/pkg/door"
+	"github.com/tonygilkerson/marty/pkg/marty"
+)
+
+func TestNode(t *testing.T) {
+
+	var msgs []string
+	n := New(func(msg string) { msgs = append(msgs, msg) })
+
+	//
+	// A car arrives while the mail is delivered and the battery charges
+	//
+	n.Send(marty.FarRising)
+	n.Send(door.DoorOpened)
+	n.Send(charger.ChargeOn)
+
+	expected := "car=Arriving door=Open charger=Charging"
+	if config := n.Configuration().String(); config != expected {
+		t.Errorf("Configuration\nexpected: %v\ngot:      %v", expected, config)
+	}
+
+	n.Send(marty.NearRising)
+	n.Send(door.DoorClosed)
+
+	expected = "car=DEFAULT door=DEFAULT charger=Charging"
+	if config := n.Configuration().String(); config != expected || n.Car.Ctx.ArrivedCount != 1 {
+		t.Errorf("Configuration\nexpected: %v {ArrivedCount:1}\ngot:      %v %+v", expected, config, n.Car.Ctx)
+	}
+
+	expected = "MailboxDoorOpened ChargerPowerSourceGood ChargerChargeStatusOn MailboxDoorClosed"
+	if strings.Join(msgs, " ") != expected {
+		t.Errorf("Messages\nexpected: %v\ngot:      %v", expected, msgs)
+	}
+}